@@ -3,57 +3,41 @@ package authorisation
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
-	"fmt"
-	"github.com/imryano/utils/random"
-	"io/ioutil"
-	"net/http"
-	"os"
 )
 
-const authServiceAddress string = "http://127.0.0.1:8080"
-
 type AccessTokenRequest struct {
-	response_type string
-	client_id     string
-	state         string
-	address       string
+	Response_Type string
+	Client_Id     string
+	State         string
+	Address       string
 }
 
 type AccessToken struct {
-	client_id     string
-	address       string
-	access_token  string
-	refresh_token string
-	token_type    string
-	expires       int
+	Client_Id     string
+	Address       string
+	Access_Token  string
+	Refresh_Token string
+	Token_Type    string
+	Expires       int
+	Jkt           string
+	Aud           []string
 }
 
+// ValidateToken validates the token as a bearer token; DPoP-bound tokens need ValidateTokenDPoP
 func (accessToken *AccessToken) ValidateToken() bool {
-	var result bool
-	url := fmt.Sprintf(authServiceAddress + "/authorise")
-	jsonAT, err := json.Marshal(accessToken)
-	if err == nil {
-		req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonAT))
-		if err == nil {
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err == nil {
-				err := json.NewDecoder(resp.Body).Decode(result)
-				defer resp.Body.Close()
-				if err == nil {
-					return result
-				}
-			}
-		}
-	}
-	return false
+	return accessToken.ValidateTokenForResource("")
+}
+
+// ValidateTokenForResource validates the token for use at the given resource (RFC 8707)
+// Audience-restricted tokens are only valid at a resource in their audience
+func (accessToken *AccessToken) ValidateTokenForResource(resource string) bool {
+	return defaultClient.ValidateToken(accessToken, resource)
 }
 
 func ValidateTokenString(accessTokenString string) bool {
 	var accessToken AccessToken
 	accessTokenBytes := []byte(accessTokenString)
-	err := json.NewDecoder(bytes.NewBuffer(accessTokenBytes)).Decode(accessToken)
+	err := json.NewDecoder(bytes.NewBuffer(accessTokenBytes)).Decode(&accessToken)
 
 	if err == nil {
 		return accessToken.ValidateToken()
@@ -62,80 +46,44 @@ func ValidateTokenString(accessTokenString string) bool {
 	return false
 }
 
-func GetClientID() (string, error) {
-	//Check clientID file first
-	dat, err := ioutil.ReadFile("/data/clientid")
-	if err == nil {
-		return string(dat), nil
-	}
+// ValidateTokenDPoP validates a DPoP-bound access token presented to a resource server
+// proof is the DPoP header of the incoming request, method and url describe that request
+// The proof is verified locally and its key thumbprint is sent to the auth service, which
+// checks it against the key the token was bound to when issued
+func (accessToken *AccessToken) ValidateTokenDPoP(proof string, method string, url string) bool {
+	return accessToken.ValidateTokenDPoPForResource(proof, method, url, "")
+}
+
+// ValidateTokenDPoPForResource is ValidateTokenDPoP for audience-restricted tokens
+func (accessToken *AccessToken) ValidateTokenDPoPForResource(proof string, method string, url string, resource string) bool {
+	return defaultClient.ValidateTokenDPoP(accessToken, proof, method, url, resource)
+}
+
+// ValidateTokenStringDPoP is ValidateTokenString for DPoP-bound access tokens
+func ValidateTokenStringDPoP(accessTokenString string, proof string, method string, url string) bool {
+	var accessToken AccessToken
+	accessTokenBytes := []byte(accessTokenString)
+	err := json.NewDecoder(bytes.NewBuffer(accessTokenBytes)).Decode(&accessToken)
 
-	url := fmt.Sprintf(authServiceAddress + "/getclientid")
-	req, err := http.NewRequest("GET", url, nil)
 	if err == nil {
-		result := ""
-		client := &http.Client{}
-		numChecks := 0
-		for numChecks < 10 && result == "" {
-			resp, err := client.Do(req)
-			if err == nil {
-				resultArr, err := ioutil.ReadAll(resp.Body)
-				result = string(resultArr)
-				//err := json.NewDecoder(resp.Body).Decode(result)
-				if err == nil {
-					err = ioutil.WriteFile("/data/clientid", resultArr, 0644)
-					return result, nil
-				}
-			}
-			numChecks += 1
-			defer resp.Body.Close()
-		}
+		return accessToken.ValidateTokenDPoP(proof, method, url)
 	}
-	return "", err
+
+	return false
 }
 
+// GetClientID returns the client ID using the default Client
+func GetClientID() (string, error) {
+	return defaultClient.GetClientID()
+}
+
+// ClearCachedClientID removes the client ID cached by the default Client
+// Use Client.ClearCachedClientID to find out whether it was removed
 func ClearCachedClientID() {
-	err := os.Remove("/data/clientid")
-	if err == nil {
-		return
-	}
+	defaultClient.ClearCachedClientID()
 }
 
+// GetAccessToken requests an access token using the default Client
 func GetAccessToken() (string, error) {
-	var err error
-	accessToken := &AccessToken{}
-	url := fmt.Sprintf(authServiceAddress + "/gettoken")
-	accessTokenRequest := &AccessTokenRequest{}
-
-	accessTokenRequest.client_id, err = GetClientID()
-	if accessTokenRequest.client_id != "" {
-		accessTokenRequest.state, err = random.GenerateRandomString(50)
-		if err == nil {
-			accessTokenRequest.response_type = "code"
-			jsonAT, err := json.Marshal(accessTokenRequest)
-			if err == nil {
-				req, err := http.NewRequest("GET", url, bytes.NewBuffer(jsonAT))
-				if err == nil {
-					client := &http.Client{}
-					numChecks := 0
-					for numChecks < 10 && err == nil {
-						resp, err := client.Do(req)
-						if err == nil {
-							err := json.NewDecoder(resp.Body).Decode(accessToken)
-							if err == nil {
-								jsonAT, err = json.Marshal(accessToken)
-								if err == nil {
-									return string(jsonAT), nil
-								}
-							}
-						}
-						numChecks += 1
-						defer resp.Body.Close()
-					}
-				}
-			}
-		}
-	} else {
-		err = errors.New("Could not get Client ID")
-	}
-	return "", err
+	return defaultClient.GetAccessToken()
 }
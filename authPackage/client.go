@@ -0,0 +1,316 @@
+package authorisation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imryano/utils/random"
+)
+
+const defaultIssuer string = "http://127.0.0.1:8080"
+const defaultCacheDir string = "/data"
+const defaultTimeout = 10 * time.Second
+const defaultRetries = 10
+
+// ClientIDCache keeps the client ID between runs so it is only requested once
+type ClientIDCache interface {
+	Load() (string, error)
+	Store(clientID string) error
+	Clear() error
+}
+
+// FileCache stores the client ID in a file
+type FileCache struct {
+	Path string
+}
+
+// MemoryCache stores the client ID for the life of the process, e.g. on read-only filesystems
+type MemoryCache struct {
+	mutex    sync.Mutex
+	clientID string
+}
+
+// Client talks to an authService
+// Create one with NewClient; the package-level functions use a Client with the default options
+type Client struct {
+	issuer     string
+	httpClient *http.Client
+	cache      ClientIDCache
+	timeout    time.Duration
+	retries    int
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+var defaultClient = NewClient()
+
+// NewClient creates a Client
+// By default it uses the authService at http://127.0.0.1:8080 and caches the client ID in /data/clientid
+func NewClient(options ...Option) *Client {
+	client := &Client{
+		issuer:     defaultIssuer,
+		httpClient: &http.Client{},
+		cache:      &FileCache{Path: filepath.Join(defaultCacheDir, "clientid")},
+		timeout:    defaultTimeout,
+		retries:    defaultRetries,
+	}
+	for _, option := range options {
+		option(client)
+	}
+	return client
+}
+
+// WithIssuer sets the base URL of the authService
+func WithIssuer(issuer string) Option {
+	return func(client *Client) {
+		client.issuer = strings.TrimRight(issuer, "/")
+	}
+}
+
+// WithHTTPClient sets the http.Client used for requests to the authService
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = httpClient
+	}
+}
+
+// WithCacheDir caches the client ID in a file called clientid in dir
+// Services sharing a host should each use their own directory
+func WithCacheDir(dir string) Option {
+	return func(client *Client) {
+		client.cache = &FileCache{Path: filepath.Join(dir, "clientid")}
+	}
+}
+
+// WithCache sets a custom client ID cache
+func WithCache(cache ClientIDCache) Option {
+	return func(client *Client) {
+		client.cache = cache
+	}
+}
+
+// WithTimeout sets the time allowed for each request to the authService
+func WithTimeout(timeout time.Duration) Option {
+	return func(client *Client) {
+		client.timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed request for a client ID or access token is attempted
+// Only failures that may pass are retried: errors reaching the authService, and 429 or 5xx responses
+func WithRetries(retries int) Option {
+	return func(client *Client) {
+		client.retries = retries
+	}
+}
+
+// GetClientID returns the cached client ID, or requests one from the authService and caches it
+func (client *Client) GetClientID() (string, error) {
+	clientID, err := client.cache.Load()
+	if err == nil && clientID != "" {
+		return clientID, nil
+	}
+
+	for attempt := 0; attempt < client.retries; attempt++ {
+		var body []byte
+		body, err = client.do("GET", "/getclientid", nil)
+		clientID = strings.TrimSpace(string(body))
+		if err == nil && clientID != "" {
+			//A failure to cache only costs another request next time
+			client.cache.Store(clientID)
+			return clientID, nil
+		} else if !retryable(err) {
+			return "", err
+		}
+	}
+	if err == nil {
+		err = errors.New("Could not get Client ID")
+	}
+	return "", err
+}
+
+// ClearCachedClientID removes the cached client ID so the next GetClientID asks the authService
+func (client *Client) ClearCachedClientID() error {
+	return client.cache.Clear()
+}
+
+// GetAccessToken requests an access token and returns it as a JSON string
+func (client *Client) GetAccessToken() (string, error) {
+	clientID, err := client.GetClientID()
+	if err != nil {
+		return "", err
+	}
+
+	accessTokenRequest := &AccessTokenRequest{Client_Id: clientID, Response_Type: "code"}
+	accessTokenRequest.State, err = random.GenerateRandomString(50)
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < client.retries; attempt++ {
+		var body []byte
+		body, err = client.do("POST", "/getaccesstoken", accessTokenRequest)
+		if err == nil {
+			accessToken := &AccessToken{}
+			err = json.Unmarshal(body, accessToken)
+			if err == nil && accessToken.Access_Token != "" {
+				jsonAT, err := json.Marshal(accessToken)
+				return string(jsonAT), err
+			}
+		} else if !retryable(err) {
+			return "", err
+		}
+	}
+	if err == nil {
+		err = errors.New("Could not get access token")
+	}
+	return "", err
+}
+
+// ValidateToken asks the authService whether the token is valid at the given resource
+// resource may be blank for tokens that are not audience-restricted
+// The token is presented as a bearer token, so a DPoP-bound token is rejected whatever its Jkt
+// Mistyped or altered tokens, and tokens that are not access tokens, are rejected without asking
+func (client *Client) ValidateToken(accessToken *AccessToken, resource string) bool {
+	return client.authorise(accessToken, resource, nil)
+}
+
+// ValidateTokenDPoP verifies the DPoP proof of the incoming request locally, then sends the proof with the
+// request's method and URL to the authService, which verifies it again and checks its key is the token's
+func (client *Client) ValidateTokenDPoP(accessToken *AccessToken, proof string, method string, requestURL string, resource string) bool {
+	if _, err := VerifyDPoPProof(proof, method, requestURL, accessToken.Access_Token); err != nil {
+		return false
+	}
+	return client.authorise(accessToken, resource, map[string]string{"DPoP": proof, "DPoP-Method": method, "DPoP-URL": requestURL})
+}
+
+// authorise sends the token to /authorise with headers, without its Jkt, which the authService only takes from a proof
+func (client *Client) authorise(accessToken *AccessToken, resource string, headers map[string]string) bool {
+	tokenType, err := ParseToken(accessToken.Access_Token)
+	if (err == nil && tokenType != AccessTokenType) || (err != nil && err != ErrUnrecognisedToken) {
+		return false
+	}
+
+	path := "/authorise"
+	if resource != "" {
+		path += "?resource=" + url.QueryEscape(resource)
+	}
+
+	presented := *accessToken
+	presented.Jkt = ""
+	body, err := client.doWithHeaders("POST", path, &presented, headers)
+	if err == nil {
+		var result bool
+		err = json.Unmarshal(body, &result)
+		return err == nil && result
+	}
+	return false
+}
+
+// do sends a request to the authService and returns the response body
+// Responses other than 200 OK are returned as errors
+func (client *Client) do(method string, path string, body interface{}) ([]byte, error) {
+	return client.doWithHeaders(method, path, body, nil)
+}
+
+// doWithHeaders is do with extra request headers
+func (client *Client) doWithHeaders(method string, path string, body interface{}, headers map[string]string) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(bodyBytes)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), client.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, client.issuer+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result, err := ioutil.ReadAll(resp.Body)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = &StatusError{StatusCode: resp.StatusCode, Message: "authService returned " + resp.Status + ": " + strings.TrimSpace(string(result))}
+	}
+	return result, err
+}
+
+// StatusError is a response from the authService other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *StatusError) Error() string {
+	return err.Message
+}
+
+// retryable reports whether a failed request may succeed if sent again
+// A 4xx other than 429 means the request itself is wrong, such as an unknown client, and sending it again would
+// only count towards a lockout
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+func (cache *FileCache) Load() (string, error) {
+	data, err := ioutil.ReadFile(cache.Path)
+	return strings.TrimSpace(string(data)), err
+}
+
+func (cache *FileCache) Store(clientID string) error {
+	return ioutil.WriteFile(cache.Path, []byte(clientID), 0644)
+}
+
+func (cache *FileCache) Clear() error {
+	err := os.Remove(cache.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (cache *MemoryCache) Load() (string, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.clientID, nil
+}
+
+func (cache *MemoryCache) Store(clientID string) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.clientID = clientID
+	return nil
+}
+
+func (cache *MemoryCache) Clear() error {
+	return cache.Store("")
+}
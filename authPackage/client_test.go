@@ -0,0 +1,153 @@
+package authorisation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getTestAuthServer(t *testing.T, clientIDRequests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /getclientid":
+			*clientIDRequests++
+			w.Write([]byte("FAKECLIENTID\n"))
+		case "POST /getaccesstoken":
+			atr := &AccessTokenRequest{}
+			json.NewDecoder(r.Body).Decode(atr)
+			if atr.Client_Id != "FAKECLIENTID" || atr.Response_Type != "code" || atr.State == "" {
+				t.Errorf("Client failed: Sent a bad access token request (%+v)", atr)
+			}
+			json.NewEncoder(w).Encode(&AccessToken{Client_Id: atr.Client_Id, Access_Token: "FAKEACCESSTOKEN", Token_Type: "Bearer"})
+		case "POST /authorise":
+			at := &AccessToken{}
+			json.NewDecoder(r.Body).Decode(at)
+			if at.Jkt != "" {
+				t.Errorf("Client failed: Sent a key thumbprint to /authorise")
+			}
+			if r.Header.Get("DPoP") != "" && (r.Header.Get("DPoP-Method") != "GET" || r.Header.Get("DPoP-URL") != testDPoPURL) {
+				t.Errorf("Client failed: Sent a DPoP proof without the request it was made for")
+			}
+			json.NewEncoder(w).Encode(at.Access_Token == "FAKEACCESSTOKEN" && r.URL.Query().Get("resource") == "https://api.example.com")
+		case "GET /slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestPassClient(t *testing.T) {
+	clientIDRequests := 0
+	server := getTestAuthServer(t, &clientIDRequests)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "authPackage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(WithIssuer(server.URL+"/"), WithCacheDir(dir))
+
+	for i := 0; i < 2; i++ {
+		clientID, err := client.GetClientID()
+		if err != nil || clientID != "FAKECLIENTID" {
+			t.Errorf("Client failed: GetClientID returned %q (%v)", clientID, err)
+		}
+	}
+	if clientIDRequests != 1 {
+		t.Errorf("Client failed: Requested the client ID %d times instead of reading the cache", clientIDRequests)
+	}
+	cached, err := ioutil.ReadFile(filepath.Join(dir, "clientid"))
+	if err != nil || string(cached) != "FAKECLIENTID" {
+		t.Errorf("Client failed: Did not cache the client ID in the cache directory (%q, %v)", cached, err)
+	}
+
+	err = client.ClearCachedClientID()
+	if err == nil {
+		client.GetClientID()
+	}
+	if err != nil || clientIDRequests != 2 {
+		t.Errorf("Client failed: ClearCachedClientID did not clear the cache (%v)", err)
+	}
+
+	value, err := client.GetAccessToken()
+	accessToken := &AccessToken{}
+	if err != nil || json.Unmarshal([]byte(value), accessToken) != nil || accessToken.Access_Token != "FAKEACCESSTOKEN" {
+		t.Fatalf("Client failed: GetAccessToken returned %q (%v)", value, err)
+	}
+	accessToken.Jkt = "ThisIsAFakeThumbprint"
+	if !client.ValidateToken(accessToken, "https://api.example.com") {
+		t.Error("Client failed: ValidateToken rejected a valid token")
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	proof, _ := NewDPoPProof(key, "GET", testDPoPURL, accessToken.Access_Token, "")
+	if !client.ValidateTokenDPoP(accessToken, proof, "GET", testDPoPURL, "https://api.example.com") {
+		t.Error("Client failed: ValidateTokenDPoP rejected a valid token")
+	}
+}
+
+func TestFailClient(t *testing.T) {
+	clientIDRequests := 0
+	server := getTestAuthServer(t, &clientIDRequests)
+	defer server.Close()
+
+	client := NewClient(WithIssuer(server.URL), WithCache(&MemoryCache{}), WithRetries(1))
+	if client.ValidateToken(&AccessToken{Access_Token: "ThisIsAFakeStringThatShouldBreak"}, "https://api.example.com") {
+		t.Error("Client failed: ValidateToken accepted an invalid token")
+	}
+	if client.ValidateToken(&AccessToken{Access_Token: "FAKEACCESSTOKEN"}, "https://other.example.com") {
+		t.Error("Client failed: ValidateToken accepted a token for the wrong resource")
+	}
+
+	client = NewClient(WithIssuer(server.URL), WithTimeout(50*time.Millisecond))
+	if _, err := client.do("GET", "/slow", nil); err == nil {
+		t.Error("Client failed: Request did not time out")
+	}
+	if _, err := client.do("GET", "/missing", nil); err == nil {
+		t.Error("Client failed: Did not report a 404 response")
+	}
+
+	client = NewClient(WithIssuer("http://127.0.0.1:1"), WithCache(&MemoryCache{}), WithRetries(2))
+	if clientID, err := client.GetClientID(); err == nil || clientID != "" {
+		t.Errorf("Client failed: GetClientID succeeded without an authService (%q)", clientID)
+	}
+}
+
+func TestFailClientRetries(t *testing.T) {
+	status := http.StatusUnauthorized
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cache := &MemoryCache{}
+	cache.Store("FAKECLIENTID")
+	client := NewClient(WithIssuer(server.URL), WithCache(cache), WithRetries(3))
+	if _, err := client.GetAccessToken(); err == nil || requests != 1 {
+		t.Errorf("Client failed: Rejected access token request was sent %d times (%v)", requests, err)
+	}
+
+	for _, status = range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		requests = 0
+		if _, err := client.GetAccessToken(); err == nil || requests != 3 {
+			t.Errorf("Client failed: Access token request answered %d was sent %d times (%v)", status, requests, err)
+		}
+	}
+
+	status = http.StatusBadRequest
+	requests = 0
+	client = NewClient(WithIssuer(server.URL), WithCache(&MemoryCache{}), WithRetries(3))
+	if _, err := client.GetClientID(); err == nil || requests != 1 {
+		t.Errorf("Client failed: Rejected client ID request was sent %d times (%v)", requests, err)
+	}
+}
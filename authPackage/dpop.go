@@ -0,0 +1,123 @@
+package authorisation
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/imryano/utils/random"
+)
+
+// dpopMaxAge is how far (in seconds) a proof's iat may be from the current time
+const dpopMaxAge int64 = 300
+
+// DPoPProof holds the verified claims of a DPoP proof JWT (RFC 9449)
+type DPoPProof struct {
+	Jti   string `json:"jti"`
+	Htm   string `json:"htm"`
+	Htu   string `json:"htu"`
+	Iat   int64  `json:"iat"`
+	Ath   string `json:"ath,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	Jkt   string `json:"-"`
+}
+
+// VerifyDPoPProof checks a DPoP proof for a request with the given method and URL
+// If accessToken is not blank the proof must also carry its hash in the ath claim
+// Replay (jti) and nonce checks are left to the caller
+func VerifyDPoPProof(proof string, method string, requestURL string, accessToken string) (*DPoPProof, error) {
+	jws, err := ParseJWS(proof)
+	if err != nil {
+		return nil, err
+	}
+	if jws.Header.Typ != "dpop+jwt" {
+		return nil, errors.New("DPoP proof has the wrong typ")
+	}
+	if jws.Header.Jwk == nil {
+		return nil, errors.New("DPoP proof has no jwk header")
+	}
+	if jws.Header.Jwk.D != "" {
+		return nil, errors.New("DPoP proof jwk contains a private key")
+	}
+
+	err = jws.Verify(jws.Header.Jwk)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DPoPProof{}
+	err = jws.Claims(result)
+	if err != nil {
+		return nil, errors.New("DPoP proof claims are not valid JSON")
+	}
+
+	if result.Jti == "" {
+		return nil, errors.New("DPoP proof has no jti")
+	}
+	if result.Htm != method {
+		return nil, errors.New("DPoP proof htm does not match the request method")
+	}
+	if normaliseHtu(result.Htu) != normaliseHtu(requestURL) {
+		return nil, errors.New("DPoP proof htu does not match the request URL")
+	}
+	now := time.Now().Unix()
+	if result.Iat < now-dpopMaxAge || result.Iat > now+dpopMaxAge {
+		return nil, errors.New("DPoP proof iat is outside the acceptable window")
+	}
+	if accessToken != "" && result.Ath != AccessTokenHash(accessToken) {
+		return nil, errors.New("DPoP proof ath does not match the access token")
+	}
+
+	result.Jkt, err = jws.Header.Jwk.Thumbprint()
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// NewDPoPProof creates a DPoP proof for a request signed with the given key
+// accessToken and nonce may be blank
+func NewDPoPProof(key *ecdsa.PrivateKey, method string, requestURL string, accessToken string, nonce string) (string, error) {
+	jti, err := random.GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	jwk := NewJSONWebKey(&key.PublicKey)
+	claims := &DPoPProof{
+		Jti:   jti,
+		Htm:   method,
+		Htu:   normaliseHtu(requestURL),
+		Iat:   time.Now().Unix(),
+		Nonce: nonce,
+	}
+	if accessToken != "" {
+		claims.Ath = AccessTokenHash(accessToken)
+	}
+
+	return SignJWS(key, JWSHeader{Typ: "dpop+jwt", Jwk: &jwk}, claims)
+}
+
+// AccessTokenHash returns the ath value for an access token
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// normaliseHtu strips the query and fragment and lower-cases the scheme and host
+func normaliseHtu(htu string) string {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return htu
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
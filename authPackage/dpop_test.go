@@ -0,0 +1,79 @@
+package authorisation
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+const testDPoPURL = "https://resource.example.com/api/items"
+
+func TestPassVerifyDPoPProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("VerifyDPoPProof failed: Could not generate key (%s)", err)
+	}
+
+	proof, err := NewDPoPProof(key, "GET", testDPoPURL+"?page=2", "ACCESSTOKEN", "")
+	if err != nil {
+		t.Fatalf("VerifyDPoPProof failed: Could not create proof (%s)", err)
+	}
+
+	result, err := VerifyDPoPProof(proof, "GET", testDPoPURL, "ACCESSTOKEN")
+	if err != nil {
+		t.Fatalf("VerifyDPoPProof failed: Valid proof was rejected (%s)", err)
+	}
+
+	jwk := NewJSONWebKey(&key.PublicKey)
+	jkt, _ := jwk.Thumbprint()
+	if result.Jkt != jkt {
+		t.Errorf("VerifyDPoPProof failed: Jkt %s does not match key thumbprint %s", result.Jkt, jkt)
+	}
+}
+
+func TestFailVerifyDPoPProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("VerifyDPoPProof failed: Could not generate key (%s)", err)
+	}
+
+	proof, err := NewDPoPProof(key, "GET", testDPoPURL, "ACCESSTOKEN", "")
+	if err != nil {
+		t.Fatalf("VerifyDPoPProof failed: Could not create proof (%s)", err)
+	}
+
+	if _, err := VerifyDPoPProof(proof, "POST", testDPoPURL, "ACCESSTOKEN"); err == nil {
+		t.Error("VerifyDPoPProof failed: Accepted a proof for the wrong method")
+	}
+	if _, err := VerifyDPoPProof(proof, "GET", "https://other.example.com/api/items", "ACCESSTOKEN"); err == nil {
+		t.Error("VerifyDPoPProof failed: Accepted a proof for the wrong URL")
+	}
+	if _, err := VerifyDPoPProof(proof, "GET", testDPoPURL, "ANOTHERACCESSTOKEN"); err == nil {
+		t.Error("VerifyDPoPProof failed: Accepted a proof for the wrong access token")
+	}
+	if _, err := VerifyDPoPProof(proof[:len(proof)-4]+"AAAA", "GET", testDPoPURL, "ACCESSTOKEN"); err == nil {
+		t.Error("VerifyDPoPProof failed: Accepted a proof with a tampered signature")
+	}
+}
+
+func TestFailVerifyCurve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Verify failed: Could not generate key (%s)", err)
+	}
+	token, err := SignJWS(key, JWSHeader{}, map[string]string{"jti": "FAKEJTI"})
+	if err != nil {
+		t.Fatalf("Verify failed: Could not sign (%s)", err)
+	}
+	jws, _ := ParseJWS(token)
+	jwk := NewJSONWebKey(&key.PublicKey)
+	if err = jws.Verify(&jwk); err != nil {
+		t.Fatalf("Verify failed: Rejected ES384 with a P-384 key (%s)", err)
+	}
+
+	jws.Header.Alg = "ES256"
+	if err = jws.Verify(&jwk); err == nil || err.Error() != "JWS algorithm does not match the key curve" {
+		t.Errorf("Verify failed: ES256 with a P-384 key was not rejected for its curve (%v)", err)
+	}
+}
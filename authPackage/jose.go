@@ -0,0 +1,295 @@
+package authorisation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// JSONWebKey is a public key in JWK form (RFC 7517)
+// Only EC (P-256, P-384, P-521) and RSA keys are supported
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	D   string `json:"d,omitempty"`
+}
+
+// JSONWebKeySet is a set of public keys as published by a client (RFC 7517 section 5)
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWSHeader is the protected header of a compact JWS
+type JWSHeader struct {
+	Alg string      `json:"alg"`
+	Typ string      `json:"typ,omitempty"`
+	Kid string      `json:"kid,omitempty"`
+	Jwk *JSONWebKey `json:"jwk,omitempty"`
+}
+
+// JWS is a parsed, but not yet verified, compact JSON Web Signature
+type JWS struct {
+	Header       JWSHeader
+	Payload      []byte
+	signingInput string
+	signature    []byte
+}
+
+// ParseJWS splits and decodes a compact JWS
+// The signature is not checked; call Verify before trusting the payload
+func ParseJWS(token string) (*JWS, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("JWS must have three parts")
+	}
+
+	jws := &JWS{signingInput: parts[0] + "." + parts[1]}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("JWS header is not base64url encoded")
+	}
+	err = json.Unmarshal(headerBytes, &jws.Header)
+	if err != nil {
+		return nil, errors.New("JWS header is not valid JSON")
+	}
+
+	jws.Payload, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("JWS payload is not base64url encoded")
+	}
+
+	jws.signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("JWS signature is not base64url encoded")
+	}
+
+	return jws, nil
+}
+
+// Claims decodes the JWS payload into v
+func (jws *JWS) Claims(v interface{}) error {
+	return json.Unmarshal(jws.Payload, v)
+}
+
+// Verify checks the JWS signature against the given public key
+// Only asymmetric algorithms are accepted, so "none" and HMAC algorithms always fail
+func (jws *JWS) Verify(key *JSONWebKey) error {
+	hash, err := jwsHash(jws.Header.Alg)
+	if err != nil {
+		return err
+	}
+	if key.Alg != "" && key.Alg != jws.Header.Alg {
+		return errors.New("JWS algorithm does not match the key")
+	}
+
+	pub, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	h := hash.New()
+	h.Write([]byte(jws.signingInput))
+	digest := h.Sum(nil)
+
+	switch jws.Header.Alg[:2] {
+	case "ES":
+		ecKey, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("JWS algorithm does not match the key type")
+		}
+		if ecKey.Curve != jwsCurves[jws.Header.Alg] {
+			return errors.New("JWS algorithm does not match the key curve")
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(jws.signature) != 2*size {
+			return errors.New("JWS signature has the wrong length")
+		}
+		r := new(big.Int).SetBytes(jws.signature[:size])
+		s := new(big.Int).SetBytes(jws.signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("JWS signature is invalid")
+		}
+	case "RS":
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("JWS algorithm does not match the key type")
+		}
+		if rsa.VerifyPKCS1v15(rsaKey, hash, digest, jws.signature) != nil {
+			return errors.New("JWS signature is invalid")
+		}
+	case "PS":
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("JWS algorithm does not match the key type")
+		}
+		if rsa.VerifyPSS(rsaKey, hash, digest, jws.signature, nil) != nil {
+			return errors.New("JWS signature is invalid")
+		}
+	}
+
+	return nil
+}
+
+// jwsHash returns the hash used by a supported JWS algorithm
+func jwsHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "ES256", "RS256", "PS256":
+		return crypto.SHA256, nil
+	case "ES384", "RS384", "PS384":
+		return crypto.SHA384, nil
+	case "ES512", "RS512", "PS512":
+		return crypto.SHA512, nil
+	}
+	return 0, errors.New("unsupported JWS algorithm: " + alg)
+}
+
+// jwsCurves is the curve each ECDSA algorithm must be used with (RFC 7518 section 3.4)
+var jwsCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// PublicKey converts the JWK into an *ecdsa.PublicKey or *rsa.PublicKey
+func (key *JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported JWK curve: " + key.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(key.X)
+		y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+		if errX != nil || errY != nil || len(x) == 0 || len(y) == 0 {
+			return nil, errors.New("JWK has an invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(key.N)
+		e, errE := base64.RawURLEncoding.DecodeString(key.E)
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("JWK has an invalid RSA modulus or exponent")
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	}
+	return nil, errors.New("unsupported JWK key type: " + key.Kty)
+}
+
+// Thumbprint returns the base64url SHA-256 JWK thumbprint of the key (RFC 7638)
+func (key *JSONWebKey) Thumbprint() (string, error) {
+	var members string
+	switch key.Kty {
+	case "EC":
+		members = `{"crv":` + jsonString(key.Crv) + `,"kty":"EC","x":` + jsonString(key.X) + `,"y":` + jsonString(key.Y) + `}`
+	case "RSA":
+		members = `{"e":` + jsonString(key.E) + `,"kty":"RSA","n":` + jsonString(key.N) + `}`
+	default:
+		return "", errors.New("unsupported JWK key type: " + key.Kty)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// FindKey returns the key with the given key ID
+// If kid is blank and the set holds exactly one key, that key is returned
+func (set *JSONWebKeySet) FindKey(kid string) *JSONWebKey {
+	if kid == "" && len(set.Keys) == 1 {
+		return &set.Keys[0]
+	}
+	for i := range set.Keys {
+		if set.Keys[i].Kid == kid {
+			return &set.Keys[i]
+		}
+	}
+	return nil
+}
+
+// SignJWS creates a compact JWS over the payload using an ECDSA private key
+// The alg header is chosen from the key's curve
+func SignJWS(key *ecdsa.PrivateKey, header JWSHeader, payload interface{}) (string, error) {
+	switch key.Curve {
+	case elliptic.P256():
+		header.Alg = "ES256"
+	case elliptic.P384():
+		header.Alg = "ES384"
+	case elliptic.P521():
+		header.Alg = "ES512"
+	default:
+		return "", errors.New("unsupported ECDSA curve")
+	}
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(payloadBytes)
+	hash, _ := jwsHash(header.Alg)
+	h := hash.New()
+	h.Write([]byte(signingInput))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// NewJSONWebKey returns the public JWK for an ECDSA key
+func NewJSONWebKey(key *ecdsa.PublicKey) JSONWebKey {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return JSONWebKey{
+		Kty: "EC",
+		Crv: key.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(x),
+		Y:   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// jsonString encodes s as a JSON string without HTML escaping
+func jsonString(s string) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,91 @@
+package authorisation
+
+import (
+	"crypto/rand"
+	"errors"
+	"hash/crc32"
+	"math/big"
+	"strings"
+)
+
+// TokenType is the kind of credential a token is, named by its prefix
+type TokenType string
+
+const (
+	AccessTokenType             TokenType = "oat"
+	RefreshTokenType            TokenType = "ort"
+	ClientSecretType            TokenType = "ocs"
+	RegistrationAccessTokenType TokenType = "orat"
+)
+
+// tokenTypes are the prefixes ParseToken recognises
+var tokenTypes = map[TokenType]bool{
+	AccessTokenType:             true,
+	RefreshTokenType:            true,
+	ClientSecretType:            true,
+	RegistrationAccessTokenType: true,
+}
+
+const tokenAlphabet string = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// tokenChecksumLength is the number of base62 characters a CRC-32 is written in
+const tokenChecksumLength int = 6
+
+var (
+	ErrUnrecognisedToken = errors.New("token has no recognised type prefix")
+	ErrMalformedToken    = errors.New("token is malformed")
+	ErrTokenChecksum     = errors.New("token checksum does not match, it has been mistyped or altered")
+)
+
+// GenerateToken creates a token of the given type with length random base62 characters
+// Tokens look like oat_<random><checksum>, where the checksum is a CRC-32 of everything before it,
+// so scanners can find leaked tokens by prefix and ParseToken can reject mistyped ones without a lookup
+func GenerateToken(tokenType TokenType, length int) (string, error) {
+	if !tokenTypes[tokenType] {
+		return "", ErrUnrecognisedToken
+	}
+	max := big.NewInt(int64(len(tokenAlphabet)))
+	random := make([]byte, length)
+	for i := range random {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		random[i] = tokenAlphabet[n.Int64()]
+	}
+	body := string(tokenType) + "_" + string(random)
+	return body + tokenChecksum(body), nil
+}
+
+// ParseToken checks the token's prefix and checksum and returns its type
+// Returns ErrUnrecognisedToken for tokens without a known prefix, such as those issued before the format existed
+func ParseToken(token string) (TokenType, error) {
+	prefix, rest, ok := strings.Cut(token, "_")
+	if !ok || !tokenTypes[TokenType(prefix)] {
+		return "", ErrUnrecognisedToken
+	}
+	if len(rest) <= tokenChecksumLength {
+		return "", ErrMalformedToken
+	}
+	for _, c := range rest {
+		if !strings.ContainsRune(tokenAlphabet, c) {
+			return "", ErrMalformedToken
+		}
+	}
+	body := token[:len(token)-tokenChecksumLength]
+	if tokenChecksum(body) != token[len(body):] {
+		return "", ErrTokenChecksum
+	}
+	return TokenType(prefix), nil
+}
+
+// tokenChecksum writes the CRC-32 of body in base62, zero padded
+func tokenChecksum(body string) string {
+	sum := crc32.ChecksumIEEE([]byte(body))
+	checksum := make([]byte, tokenChecksumLength)
+	for i := tokenChecksumLength - 1; i >= 0; i-- {
+		checksum[i] = tokenAlphabet[sum%uint32(len(tokenAlphabet))]
+		sum /= uint32(len(tokenAlphabet))
+	}
+	return string(checksum)
+}
@@ -0,0 +1,53 @@
+package authorisation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPassParseToken(t *testing.T) {
+	for _, tokenType := range []TokenType{AccessTokenType, RefreshTokenType, ClientSecretType, RegistrationAccessTokenType} {
+		token, err := GenerateToken(tokenType, 40)
+		if err != nil {
+			t.Fatalf("ParseToken failed: Could not generate %s token (%s)", tokenType, err)
+		}
+		if !strings.HasPrefix(token, string(tokenType)+"_") || len(token) != len(tokenType)+1+40+tokenChecksumLength {
+			t.Errorf("ParseToken failed: Generated token %s has the wrong prefix or length", token)
+		}
+		parsed, err := ParseToken(token)
+		if err != nil || parsed != tokenType {
+			t.Errorf("ParseToken failed: Parsed %s as %q (%v)", token, parsed, err)
+		}
+	}
+}
+
+func TestFailParseToken(t *testing.T) {
+	token, _ := GenerateToken(AccessTokenType, 40)
+
+	//Change one character of the random part
+	typo := []byte(token)
+	if typo[10] == 'a' {
+		typo[10] = 'b'
+	} else {
+		typo[10] = 'a'
+	}
+	for name, test := range map[string]struct {
+		token    string
+		expected error
+	}{
+		"typo":      {string(typo), ErrTokenChecksum},
+		"truncated": {token[:len(token)-1], ErrTokenChecksum},
+		"legacy":    {"kZ2-xY_9fakeLegacyToken", ErrUnrecognisedToken},
+		"unknown":   {"xyz_" + token[4:], ErrUnrecognisedToken},
+		"short":     {"oat_abc", ErrMalformedToken},
+		"alphabet":  {"oat_" + strings.Repeat("-", 40), ErrMalformedToken},
+	} {
+		if _, err := ParseToken(test.token); err != test.expected {
+			t.Errorf("ParseToken failed: %s token returned %v, expected %v", name, err, test.expected)
+		}
+	}
+
+	if _, err := GenerateToken(TokenType("xyz"), 40); err == nil {
+		t.Errorf("ParseToken failed: Generated a token with an unknown prefix")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// trustedProxies are the parsed server.trusted_proxies; main sets them once the configuration is loaded
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses CIDRs, accepting a bare IP address as a network of one
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("server.trusted_proxies: " + cidr + " is not an IP address or CIDR")
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("server.trusted_proxies: " + cidr + " is not an IP address or CIDR")
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// clientAddress is the address a request came from, without the port
+// When the connection is from a trusted proxy the forwarding headers are read from the nearest hop back,
+// and the first address not belonging to a trusted proxy is the client; anything before it may be forged
+func clientAddress(r *http.Request) string {
+	address := normalizeAddress(r.RemoteAddr)
+	if !isTrustedProxy(address) {
+		return address
+	}
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := normalizeAddress(hops[i])
+		if net.ParseIP(hop) == nil {
+			//An obfuscated or unknown hop cannot be checked, so stop at the last address known to be real
+			return address
+		}
+		address = hop
+		if !isTrustedProxy(address) {
+			return address
+		}
+	}
+	return address
+}
+
+// forwardedFor lists the addresses in the Forwarded header, or X-Forwarded-For if there is none, client first
+func forwardedFor(r *http.Request) []string {
+	hops := []string{}
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hop = strings.Trim(value, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAddress reduces an address to the canonical form of its IP: the port, brackets and IPv6 zone
+// are removed, IPv4-mapped IPv6 addresses become IPv4 and IPv6 is written in its shortest form
+// Anything that is not an IP address, such as a host name, is returned without its port
+func normalizeAddress(address string) string {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if zone := strings.IndexByte(address, '%'); zone >= 0 {
+		address = address[:zone]
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+// normalizeStoredAddresses rewrites addresses stored by earlier versions, which kept the port and IPv6 in
+// whatever form it arrived, to the form clientAddress returns so they match again
+// Returns the number of documents changed, or in a dry run the number that would be
+func normalizeStoredAddresses(c *mgo.Collection, dryRun bool) (int, error) {
+	//Plain IPv4 addresses are already normal, anything with a port, bracket, zone or colon may not be
+	iter := c.Find(bson.M{"address": bson.M{"$regex": "[:\\[%]"}}).Select(bson.M{"address": 1}).Iter()
+	changed := 0
+	stored := struct {
+		Id      bson.ObjectId `bson:"_id"`
+		Address string        `bson:"address"`
+	}{}
+	for iter.Next(&stored) {
+		address := normalizeAddress(stored.Address)
+		if address == stored.Address {
+			continue
+		}
+		if !dryRun {
+			if err := c.UpdateId(stored.Id, bson.M{"$set": bson.M{"address": address}}); err != nil {
+				iter.Close()
+				return changed, err
+			}
+		}
+		changed++
+	}
+	return changed, iter.Close()
+}
+
+// anyAddress binds a client to no address at all
+const anyAddress string = "*"
+
+// addressSet is an address binding parsed for matching, so CIDRs are not parsed again for every address checked
+type addressSet struct {
+	any       bool
+	addresses map[string]bool
+	networks  []*net.IPNet
+}
+
+// parseAddressSet parses a binding of *, CIDRs and addresses, normalizing the addresses
+// The error names the first pattern that is none of them; the set still holds the rest, and an address that is not
+// an IP address only matches itself, as addresses stored by earlier versions may not be
+func parseAddressSet(patterns []string) (*addressSet, error) {
+	set := &addressSet{addresses: map[string]bool{}}
+	var err error
+	for _, pattern := range patterns {
+		if pattern == anyAddress {
+			set.any = true
+			continue
+		}
+		if strings.Contains(pattern, "/") {
+			if _, network, cidrErr := net.ParseCIDR(pattern); cidrErr == nil {
+				set.networks = append(set.networks, network)
+				continue
+			}
+		} else {
+			address := normalizeAddress(pattern)
+			set.addresses[address] = true
+			if net.ParseIP(address) != nil {
+				continue
+			}
+		}
+		if err == nil {
+			err = errors.New("allowed_addresses: " + pattern + " is not *, an IP address or a CIDR")
+		}
+	}
+	return set, err
+}
+
+// validateAddressPatterns checks every entry of an allowed_addresses list is *, an IP address or a CIDR
+func validateAddressPatterns(patterns []string) error {
+	_, err := parseAddressSet(patterns)
+	return err
+}
+
+// matches reports whether address is allowed by the set, comparing it after normalizing
+func (set *addressSet) matches(address string) bool {
+	address = normalizeAddress(address)
+	if set.any || set.addresses[address] {
+		return true
+	}
+	ip := net.ParseIP(address)
+	for _, network := range set.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressBinding is the addresses the client may use: its allowed_addresses if it has any, otherwise the
+// single address it registered from, or any address if it has neither
+func (client *Client) addressBinding() []string {
+	if len(client.Allowed_Addresses) > 0 {
+		return client.Allowed_Addresses
+	}
+	if client.Address != "" {
+		return []string{client.Address}
+	}
+	return []string{anyAddress}
+}
+
+// allowedAddresses is the client's binding parsed for matching, parsed once when it is first needed after the
+// client is loaded; the patterns were validated when they were stored
+func (client *Client) allowedAddresses() *addressSet {
+	if client.allowed == nil {
+		client.allowed, _ = parseAddressSet(client.addressBinding())
+	}
+	return client.allowed
+}
+
+// addressBinding is the binding copied from the client when the token was issued
+// Tokens issued before clients had allowed_addresses are bound to the address they were issued to
+func (at *AccessToken) addressBinding() []string {
+	if len(at.Allowed_Addresses) > 0 {
+		return at.Allowed_Addresses
+	}
+	return []string{at.Address}
+}
+
+// allowedAddresses is the token's binding parsed for matching, parsed once when it is first needed
+func (at *AccessToken) allowedAddresses() *addressSet {
+	if at.allowed == nil {
+		at.allowed, _ = parseAddressSet(at.addressBinding())
+	}
+	return at.allowed
+}
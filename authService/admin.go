@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imryano/OAuth/authPackage"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const adminPath string = "/admin/"
+
+// adminListLimit is the default and maximum number of results returned by an admin list
+const adminListLimit = 100
+
+// ClientInfo is the admin view of a client; secrets are never included
+type ClientInfo struct {
+	ClientMetadata
+	Client_Id              string    `json:"client_id"`
+	Address                string    `json:"address"`
+	Allowed_Addresses      []string  `json:"allowed_addresses,omitempty"`
+	Disabled               bool      `json:"disabled"`
+	Require_Par            bool      `json:"require_par"`
+	Require_Signed_Request bool      `json:"require_signed_request"`
+	Allowed_Resources      []string  `json:"allowed_resources,omitempty"`
+	Created                time.Time `json:"created"`
+}
+
+// TokenInfo is the admin view of an access token; the token values are never included
+type TokenInfo struct {
+	Id         bson.ObjectId `json:"id"`
+	Client_Id  string        `json:"client_id"`
+	Address    string        `json:"address"`
+	Token_Type string        `json:"token_type"`
+	Expires    int           `json:"expires"`
+	Scope      string        `json:"scope,omitempty"`
+	Aud        []string      `json:"aud,omitempty"`
+	Jkt        string        `json:"jkt,omitempty"`
+	Created    time.Time     `json:"created"`
+}
+
+// AdminClientRequest creates a client through the admin API
+// Unlike /register it can set the admin scope and the server-side client options
+type AdminClientRequest struct {
+	ClientRegistrationRequest
+	Require_Par            bool     `json:"require_par"`
+	Require_Signed_Request bool     `json:"require_signed_request"`
+	Allowed_Resources      []string `json:"allowed_resources"`
+}
+
+// MintRequest issues a token to a client through the admin API, e.g. for testing
+type MintRequest struct {
+	Client_Id string   `json:"client_id"`
+	Scope     string   `json:"scope,omitempty"`
+	Resource  []string `json:"resource,omitempty"`
+}
+
+// ExportData is every client and token, as written by /admin/export and read by /admin/import
+type ExportData struct {
+	Clients      []Client        `json:"clients"`
+	AccessTokens []exportedToken `json:"accessTokens"`
+}
+
+// exportedToken is a stored token with its DPoP key thumbprint, which AccessToken leaves out of JSON so that
+// /authorise cannot be sent one
+type exportedToken struct {
+	AccessToken
+	Jkt string `json:"Jkt,omitempty"`
+}
+
+// RevokeRequest selects the tokens to revoke in bulk; at least one field must be set
+type RevokeRequest struct {
+	Client_Id string   `json:"client_id,omitempty"`
+	Address   string   `json:"address,omitempty"`
+	Ids       []string `json:"ids,omitempty"`
+}
+
+// AdminHandler serves the /admin API
+// Every request needs an access token with the admin scope
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminAuthorised(r)
+	if !ok {
+		authFailed(r, "")
+		audit(r, auditAdminDenied, admin, "", map[string]string{"method": r.Method, "path": r.URL.Path})
+		writeOAuthError(w, http.StatusForbidden, "insufficient_scope", "An access token with the admin scope is required")
+		return
+	}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminPath), "/"), "/")
+	route := r.Method + " " + path[0]
+	if len(path) > 1 && path[1] == "revoke" {
+		route += "/revoke"
+	} else if len(path) > 1 {
+		route += "/{id}"
+	}
+	if len(path) > 2 {
+		route += "/" + path[2]
+	}
+
+	//Everything but reads is audited, and exports and backups too as they include secrets
+	if r.Method != "GET" || route == "GET export" || route == "GET backup" {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = recorder
+		defer func() {
+			target := ""
+			if len(path) > 1 && path[1] != "revoke" {
+				target = path[1]
+			}
+			audit(r, auditAdminAction, admin, target, map[string]string{"route": route, "status": strconv.Itoa(recorder.status)})
+		}()
+	}
+
+	switch route {
+	case "GET clients":
+		adminListClients(w, r)
+	case "POST clients":
+		adminCreateClient(w, r)
+	case "GET clients/{id}":
+		adminGetClient(w, path[1])
+	case "DELETE clients/{id}":
+		adminDeleteClient(w, path[1])
+	case "POST clients/{id}/disable":
+		adminSetClientDisabled(w, path[1], true)
+	case "POST clients/{id}/enable":
+		adminSetClientDisabled(w, path[1], false)
+	case "POST clients/{id}/secret":
+		adminRotateSecret(w, path[1])
+	case "PUT clients/{id}/keys":
+		adminRotateKeys(w, r, path[1])
+	case "GET clients/{id}/tokens":
+		adminListTokens(w, tokenFilter{Client_Id: path[1]})
+	case "DELETE clients/{id}/tokens":
+		adminRevokeTokens(w, tokenFilter{Client_Id: path[1]})
+	case "POST tokens/revoke":
+		revoke := &RevokeRequest{}
+		err := json.NewDecoder(r.Body).Decode(revoke)
+		if err != nil || (revoke.Client_Id == "" && revoke.Address == "" && len(revoke.Ids) == 0) {
+			http.Error(w, "Please send client_id, address or ids", http.StatusBadRequest)
+			return
+		}
+		adminRevokeTokens(w, revoke.filter())
+	case "POST tokens":
+		adminMintToken(w, r)
+	case "GET export":
+		adminExport(w)
+	case "GET backup":
+		adminBackup(w)
+	case "POST import":
+		adminImport(w, r)
+	case "GET tokens/{id}":
+		if !bson.IsObjectIdHex(path[1]) {
+			http.NotFound(w, r)
+			return
+		}
+		adminListTokens(w, tokenFilter{Ids: []bson.ObjectId{bson.ObjectIdHex(path[1])}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// adminAuthorised checks the request presents an access token with the admin scope
+// DPoP-bound tokens must be presented with a DPoP proof for this request
+// Returns the client_id the token was issued to, if the token was found
+func adminAuthorised(r *http.Request) (string, bool) {
+	authorization := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(authorization) != 2 || authorization[1] == "" {
+		return "", false
+	}
+
+	accessToken := AccessToken{Access_Token: authorization[1]}
+	if !accessTokenFormatAccepted(accessToken.Access_Token) {
+		return "", false
+	}
+	switch strings.ToLower(authorization[0]) {
+	case "bearer":
+	case "dpop":
+		proof, err := verifyDPoPRequest(r, accessToken.Access_Token, false)
+		if err != nil {
+			return "", false
+		}
+		accessToken.Jkt = proof.Jkt
+	default:
+		return "", false
+	}
+
+	stored, err := store.findToken(accessToken.Access_Token)
+	if err != nil {
+		return "", false
+	}
+	return stored.Client_Id, stored.Jkt == accessToken.Jkt && hasScope(stored.Scope, adminScope)
+}
+
+// adminListClients lists clients, optionally filtered by the q, address and disabled query parameters
+// q matches the start of the client id or client name
+func adminListClients(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	filter := clientFilter{Prefix: params.Get("q"), Address: normalizeAddress(params.Get("address")), Limit: adminListLimit}
+	if disabled := params.Get("disabled"); disabled != "" {
+		filter.Disabled = new(bool)
+		*filter.Disabled = disabled == "true"
+	}
+	if l, err := strconv.Atoi(params.Get("limit")); err == nil && l > 0 && l < adminListLimit {
+		filter.Limit = l
+	}
+
+	clients, err := store.listClients(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := []ClientInfo{}
+	for _, client := range clients {
+		result = append(result, client.info())
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func adminCreateClient(w http.ResponseWriter, r *http.Request) {
+	request := &AdminClientRequest{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err == nil {
+		err = request.ClientMetadata.validate()
+	}
+	if err == nil {
+		err = validateAddressPatterns(request.Allowed_Addresses)
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", err.Error())
+		return
+	}
+
+	client := &Client{
+		ClientMetadata:         request.ClientMetadata,
+		Address:                normalizeAddress(request.Address),
+		Allowed_Addresses:      request.Allowed_Addresses,
+		Require_Par:            request.Require_Par,
+		Require_Signed_Request: request.Require_Signed_Request,
+		Allowed_Resources:      request.Allowed_Resources,
+		Created:                time.Now(),
+	}
+	response, err := createRegisteredClient(client)
+	if err != nil {
+		logAttrs(r, slog.String("error", err.Error()))
+		http.Error(w, "Could not create client", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+func adminGetClient(w http.ResponseWriter, client_id string) {
+	client, err := store.findClient(client_id)
+	if err != nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, client.info())
+}
+
+func adminDeleteClient(w http.ResponseWriter, client_id string) {
+	client, err := store.findClient(client_id)
+	if err == nil {
+		err = deleteRegisteredClient(client)
+	}
+	if err != nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminSetClientDisabled disables or re-enables a client
+// Disabling also revokes every token issued to the client
+func adminSetClientDisabled(w http.ResponseWriter, client_id string, disabled bool) {
+	client, err := store.findClient(client_id)
+	if err == errNotFound {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		client.Disabled = disabled
+		err = store.saveClient(client)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if disabled {
+		revokeTokens(tokenFilter{Client_Id: client_id}, "client_disabled")
+	}
+	adminGetClient(w, client_id)
+}
+
+// adminRotateSecret replaces the client's secret and returns the new one
+// Tokens already issued to the client are not affected
+func adminRotateSecret(w http.ResponseWriter, client_id string) {
+	client, err := store.findClient(client_id)
+	if err != nil || client.Token_Endpoint_Auth_Method == "none" {
+		http.Error(w, "Client not found or has no secret", http.StatusNotFound)
+		return
+	}
+
+	secret, err := authorisation.GenerateToken(authorisation.ClientSecretType, config.Tokens.Length)
+	if err == nil {
+		client.Client_Secret_Hash = hashSecret(secret)
+		err = store.saveClient(client)
+	}
+	if err != nil {
+		logger.Error("Could not rotate client secret", "client_id", client_id, "error", err)
+		http.Error(w, "Could not rotate secret", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"client_id": client_id, "client_secret": secret})
+}
+
+// adminRotateKeys replaces the keys the client signs request objects with
+// To rotate without rejecting requests in flight, send the old and new keys together, then the new key alone later
+func adminRotateKeys(w http.ResponseWriter, r *http.Request, client_id string) {
+	client, err := store.findClient(client_id)
+	if err != nil {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	jwks := &authorisation.JSONWebKeySet{}
+	err = json.NewDecoder(r.Body).Decode(jwks)
+	if err == nil && len(jwks.Keys) == 0 {
+		err = errors.New("jwks must contain at least one key")
+	}
+	if err == nil {
+		metadata := client.ClientMetadata
+		metadata.Jwks = jwks
+		err = metadata.validate()
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", err.Error())
+		return
+	}
+
+	client.Jwks = jwks
+	err = store.saveClient(client)
+	if err != nil {
+		logger.Error("Could not rotate client keys", "client_id", client_id, "error", err)
+		http.Error(w, "Could not rotate keys", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, client.info())
+}
+
+// adminMintToken issues a new token to an enabled client without client authentication
+func adminMintToken(w http.ResponseWriter, r *http.Request) {
+	mint := &MintRequest{}
+	err := json.NewDecoder(r.Body).Decode(mint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := store.findClient(mint.Client_Id)
+	if err != nil || client.Disabled {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
+	}
+
+	atr := &AccessTokenRequest{Client_Id: client.Client_Id, Address: client.Address, Scope: mint.Scope, Resource: mint.Resource}
+	err = atr.checkScope()
+	if err == nil {
+		err = atr.checkResources()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	accessToken := atr.createAccessToken()
+	if accessToken == nil {
+		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
+	}
+	tokensIssued.WithLabelValues(clientLabel(client.Client_Id), accessToken.Token_Type, "admin").Inc()
+	writeJSON(w, http.StatusCreated, accessToken)
+}
+
+// adminExport dumps every client and token, including secret and token hashes
+func adminExport(w http.ResponseWriter) {
+	data := &ExportData{AccessTokens: []exportedToken{}}
+	clients, err := store.listClients(clientFilter{})
+	if err == nil {
+		data.Clients = clients
+		var tokens []AccessToken
+		tokens, err = store.listTokens(tokenFilter{}, 0)
+		for _, accessToken := range tokens {
+			data.AccessTokens = append(data.AccessTokens, exportedToken{AccessToken: accessToken, Jkt: accessToken.Jkt})
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// adminBackup streams a copy of the database file, for backends that can make one while serving
+// A large file takes longer to send than server.write_timeout allows, so the deadline is lifted for the copy
+func adminBackup(w http.ResponseWriter) {
+	backup, ok := store.(backupStorage)
+	if !ok {
+		http.Error(w, "The "+config.Database.Backend+" backend is backed up with the database's own tools", http.StatusNotImplemented)
+		return
+	}
+
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logger.Warn("Could not lift the write deadline for the backup", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="authService.db"`)
+	_, err := backup.backup(w, func(size int64) {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	})
+	if err != nil {
+		logger.Error("Backup failed", "error", err)
+	}
+}
+
+// adminImport loads an export, replacing clients with the same client id and tokens with the same ID
+func adminImport(w http.ResponseWriter, r *http.Request) {
+	data := &ExportData{}
+	err := json.NewDecoder(r.Body).Decode(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//Bindings are checked before anything is saved, so a bad pattern is reported here rather than never matching later
+	for _, client := range data.Clients {
+		if err = validateAddressPatterns(client.Allowed_Addresses); err != nil {
+			http.Error(w, client.Client_Id+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, client := range data.Clients {
+		client.Id = ""
+		err = store.saveClient(&client)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, exported := range data.AccessTokens {
+		accessToken := exported.AccessToken
+		accessToken.Jkt = exported.Jkt
+		err = store.saveToken(&accessToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"clients": len(data.Clients), "accessTokens": len(data.AccessTokens)})
+}
+
+func adminListTokens(w http.ResponseWriter, filter tokenFilter) {
+	tokens, err := store.listTokens(filter, adminListLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := []TokenInfo{}
+	for _, token := range tokens {
+		result = append(result, token.info())
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func adminRevokeTokens(w http.ResponseWriter, filter tokenFilter) {
+	removed, err := revokeTokens(filter, "admin")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"revoked": removed})
+}
+
+// revokeTokens removes the tokens matching the filter a client at a time, so the revocations are counted by client
+// Tokens issued to other clients while it runs are removed at the end and counted as other
+func revokeTokens(filter tokenFilter, reason string) (int, error) {
+	clients := []string{filter.Client_Id}
+	if filter.Client_Id == "" {
+		tokens, err := store.listTokens(filter, 0)
+		if err != nil {
+			return 0, err
+		}
+		seen := map[string]bool{}
+		clients = []string{}
+		for _, token := range tokens {
+			if !seen[token.Client_Id] {
+				seen[token.Client_Id] = true
+				clients = append(clients, token.Client_Id)
+			}
+		}
+	}
+
+	removed := 0
+	for _, client_id := range clients {
+		clientTokens := filter
+		clientTokens.Client_Id = client_id
+		count, err := store.removeTokens(clientTokens)
+		removed += count
+		tokensRevoked.WithLabelValues(clientLabel(client_id), reason).Add(float64(count))
+		if err != nil {
+			return removed, err
+		}
+	}
+	if filter.Client_Id == "" {
+		count, err := store.removeTokens(filter)
+		removed += count
+		if count > 0 {
+			tokensRevoked.WithLabelValues(otherClient, reason).Add(float64(count))
+		}
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (revoke *RevokeRequest) filter() tokenFilter {
+	filter := tokenFilter{Client_Id: revoke.Client_Id, Address: normalizeAddress(revoke.Address)}
+	if len(revoke.Ids) > 0 {
+		filter.Ids = []bson.ObjectId{}
+		for _, id := range revoke.Ids {
+			if bson.IsObjectIdHex(id) {
+				filter.Ids = append(filter.Ids, bson.ObjectIdHex(id))
+			}
+		}
+	}
+	return filter
+}
+
+func (client *Client) info() ClientInfo {
+	return ClientInfo{
+		ClientMetadata:         client.ClientMetadata,
+		Client_Id:              client.Client_Id,
+		Address:                client.Address,
+		Allowed_Addresses:      client.Allowed_Addresses,
+		Disabled:               client.Disabled,
+		Require_Par:            client.Require_Par,
+		Require_Signed_Request: client.Require_Signed_Request,
+		Allowed_Resources:      client.Allowed_Resources,
+		Created:                client.Created,
+	}
+}
+
+func (at *AccessToken) info() TokenInfo {
+	return TokenInfo{
+		Id:         at.Id,
+		Client_Id:  at.Client_Id,
+		Address:    at.Address,
+		Token_Type: at.Token_Type,
+		Expires:    at.Expires,
+		Scope:      at.Scope,
+		Aud:        at.Aud,
+		Jkt:        at.Jkt,
+		Created:    at.Created,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const auditCol string = "auditLog"
+
+// auditRetries is how many times an append is retried when another instance takes the same sequence number
+const auditRetries int = 10
+
+// Audit events
+const (
+	auditClientRegistered = "client_registered"
+	auditClientUpdated    = "client_updated"
+	auditClientDeleted    = "client_deleted"
+	auditTokenIssued      = "token_issued"
+	auditAuthFailed       = "auth_failed"
+	auditAdminAction      = "admin_action"
+	auditAdminDenied      = "admin_denied"
+	auditLockout          = "lockout"
+)
+
+// AuditEntry is one security event in the audit log
+// Entries are numbered from 1 with no gaps, and each includes the hash of the one before,
+// so removing, reordering or editing an entry breaks the chain from that point on
+// The hash is an HMAC keyed with auditKey, so the chain cannot be rebuilt after an edit without the key
+type AuditEntry struct {
+	Seq        int64             `json:"seq" bson:"_id"`
+	Time       time.Time         `json:"time" bson:"time"`
+	Event      string            `json:"event" bson:"event"`
+	Actor      string            `json:"actor,omitempty" bson:"actor,omitempty"`
+	Client_Id  string            `json:"client_id,omitempty" bson:"client_id,omitempty"`
+	Address    string            `json:"address,omitempty" bson:"address,omitempty"`
+	Request_Id string            `json:"request_id,omitempty" bson:"request_id,omitempty"`
+	Details    map[string]string `json:"details,omitempty" bson:"details,omitempty"`
+	Prev_Hash  string            `json:"prev_hash" bson:"prev_hash"`
+	Hash       string            `json:"hash" bson:"hash"`
+}
+
+// audit records a security event for the request
+// actor is the client acting, for admin actions the admin client; client_id is the client acted on
+// Details must never contain token or secret values
+// A failure to write is logged rather than failing the request
+func audit(r *http.Request, event string, actor string, client_id string, details map[string]string) {
+	entry := &AuditEntry{Event: event, Actor: actor, Client_Id: client_id, Address: clientAddress(r), Details: details}
+	if log, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.Request_Id = log.requestID
+	}
+	err := appendAudit(entry)
+	if err != nil {
+		requestLogger(r).Error("Could not write audit log entry", "event", event, "client_id", client_id, "error", err)
+	}
+}
+
+// appendAudit adds the entry to the end of the audit log
+// Instances append concurrently; the storage keeps the sequence numbers unique and without gaps
+func appendAudit(entry *AuditEntry) error {
+	defer observeStorage("audit", time.Now())
+	//MongoDB stores times to the millisecond, so hash the time as it will be read back
+	entry.Time = time.Now().UTC().Truncate(time.Millisecond)
+	return store.appendAudit(entry)
+}
+
+// auditKey is the key audit entries are hashed with: audit.key, or tokens.pepper if it is not set
+func auditKey() string {
+	if config.Audit.Key != "" {
+		return config.Audit.Key
+	}
+	return config.Tokens.Pepper
+}
+
+// computeHash hashes every field of the entry except Hash itself
+// With a key the hash is an HMAC-SHA256; without one, as written before audit keys, it is a plain SHA-256
+func (entry *AuditEntry) computeHash(key string) string {
+	unhashed := *entry
+	unhashed.Hash = ""
+	unhashed.Time = entry.Time.UTC()
+	data, _ := json.Marshal(&unhashed)
+	if key == "" {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyAuditLog checks the audit log is complete and unedited, writing each problem found to w
+// Returns the number of entries checked and the number of problems
+// Entries written before a key was set only have a plain hash, which anyone can recompute; they are reported,
+// but only count as problems once an entry with a keyed hash has been seen
+// Deleting entries from the end of the log cannot be detected from the log alone; compare the
+// reported last entry with a copy kept elsewhere
+func verifyAuditLog(s storage, w io.Writer) (int, int) {
+	entries, problems := 0, 0
+	key := auditKey()
+	keyed := false
+	var firstUnkeyed, lastUnkeyed int64
+	previous := &AuditEntry{}
+	err := s.eachAuditEntry(func(entry *AuditEntry) error {
+		entries++
+		if entry.Seq != previous.Seq+1 {
+			fmt.Fprintf(w, "entry %d: follows entry %d, entries %d to %d are missing\n", entry.Seq, previous.Seq, previous.Seq+1, entry.Seq-1)
+			problems++
+		}
+		if entry.Prev_Hash != previous.Hash {
+			fmt.Fprintf(w, "entry %d: previous hash does not match entry %d\n", entry.Seq, previous.Seq)
+			problems++
+		}
+		switch {
+		case key != "" && entry.computeHash(key) == entry.Hash:
+			keyed = true
+		case entry.computeHash("") != entry.Hash:
+			fmt.Fprintf(w, "entry %d: contents do not match its hash, it has been edited\n", entry.Seq)
+			problems++
+		case key != "" && keyed:
+			fmt.Fprintf(w, "entry %d: hash is not keyed but follows keyed entries, it has been rewritten\n", entry.Seq)
+			problems++
+		case key != "":
+			if firstUnkeyed == 0 {
+				firstUnkeyed = entry.Seq
+			}
+			lastUnkeyed = entry.Seq
+		}
+		*previous = *entry
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(w, "could not read the audit log: %s\n", err)
+		problems++
+	}
+
+	if key == "" {
+		fmt.Fprintln(w, "no audit key is set, so the hashes only show accidental changes")
+	} else if firstUnkeyed != 0 {
+		fmt.Fprintf(w, "entries %d to %d were written without the audit key and could have been rewritten\n", firstUnkeyed, lastUnkeyed)
+	}
+	fmt.Fprintf(w, "%d entries checked, %d problems\n", entries, problems)
+	if entries > 0 {
+		fmt.Fprintf(w, "last entry %d at %s, hash %s\n", previous.Seq, previous.Time.Format(time.RFC3339), previous.Hash)
+	}
+	return entries, problems
+}
+
+// runVerifyAudit implements authService verify-audit
+// Returns the process exit code: 0 if the log is intact, 1 if problems were found, 2 on bad arguments
+func runVerifyAudit(args []string, stdout io.Writer, stderr io.Writer) int {
+	cfg, _, err := loadConfig(args, stderr)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(stderr, err)
+		}
+		return 2
+	}
+	config = cfg
+
+	s, err := newStorage(config.Database)
+	if err != nil {
+		fmt.Fprintln(stderr, "could not connect to the database:", err)
+		return 1
+	}
+	defer s.close()
+
+	_, problems := verifyAuditLog(s, stdout)
+	if problems > 0 {
+		return 1
+	}
+	return 0
+}
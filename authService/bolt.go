@@ -0,0 +1,858 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imryano/utils/random"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Index buckets; the other buckets are named after the MongoDB collections they replace
+const (
+	// clientAddresses holds address + "\x00" + client_id for each client
+	clientAddressIndex string = "clientAddresses"
+	// clientBindings maps binding_key to client_id
+	clientBindingIndex string = "clientBindings"
+	// tokenHashes maps access_token_hash to token ID
+	tokenHashIndex string = "tokenHashes"
+	// clientTokens holds client_id + "\x00" + token ID for each token
+	clientTokenIndex string = "clientTokens"
+	// addressTokens holds address + "\x00" + token ID for each token
+	addressTokenIndex string = "addressTokens"
+	// tokenExpiry holds expires_at + token ID for each token, so the sweep reads expired tokens first
+	tokenExpiryIndex string = "tokenExpiry"
+)
+
+var errBoltNotPrepared = errors.New("database has not been prepared, run authService -migrate-only")
+
+// boltStorage keeps everything in the bbolt file at database.url, so authService runs without a database server
+// bbolt locks the file, so only one instance can use it; records are stored as BSON, as in MongoDB
+// bbolt has no TTL indexes, so a worker deletes expired records every minute; reads ignore them until then
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// boltMigration is one change to the buckets in the file
+// Versions are permanent: add new migrations to the end of boltMigrations and never renumber or remove one
+type boltMigration struct {
+	version int
+	name    string
+	apply   func(tx *bolt.Tx) error
+}
+
+// boltMigrations are applied in order, each once per file, and recorded in the migrations bucket
+var boltMigrations = []boltMigration{
+	{1, "create_buckets", func(tx *bolt.Tx) error {
+		for _, name := range []string{clientCol, clientAddressIndex, clientBindingIndex, accessTokenCol, tokenHashIndex,
+			clientTokenIndex, addressTokenIndex, tokenExpiryIndex, pushedRequestCol, dpopNonceCol, dpopJtiCol, auditCol,
+			rateLimitCol, lockoutCol} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+		return nil
+	}},
+	{2, "create_request_object_jtis", func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(requestObjectJtiCol))
+		return err
+	}},
+}
+
+// openBolt opens the file at path, creating it if there is none
+// Fails after a second if another process has the file open
+func openBolt(path string) (*boltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errors.New(path + " is in use by another process")
+	} else if err != nil {
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
+
+// view runs fn in a read transaction, once prepare has created the buckets
+func (b *boltStorage) view(fn func(tx *bolt.Tx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(clientCol)) == nil {
+			return errBoltNotPrepared
+		}
+		return fn(tx)
+	})
+}
+
+// update runs fn in a write transaction, once prepare has created the buckets
+// bbolt runs one write transaction at a time, so fn sees no concurrent changes
+func (b *boltStorage) update(fn func(tx *bolt.Tx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(clientCol)) == nil {
+			return errBoltNotPrepared
+		}
+		return fn(tx)
+	})
+}
+
+func boltBucket(tx *bolt.Tx, name string) *bolt.Bucket {
+	return tx.Bucket([]byte(name))
+}
+
+// getRecord decodes the record at key into v, or returns errNotFound
+func getRecord(bkt *bolt.Bucket, key []byte, v interface{}) error {
+	data := bkt.Get(key)
+	if data == nil {
+		return errNotFound
+	}
+	return bson.Unmarshal(data, v)
+}
+
+func putRecord(bkt *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(key, data)
+}
+
+// boltTime encodes a time so keys sort in time order
+func boltTime(t time.Time) []byte {
+	key := make([]byte, 8)
+	if nanos := t.UnixNano(); nanos > 0 {
+		binary.BigEndian.PutUint64(key, uint64(nanos))
+	}
+	return key
+}
+
+func boltSeq(seq int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(seq))
+	return key
+}
+
+// indexKey joins a value and a record key, so a prefix scan for value+"\x00" finds its records
+func indexKey(value string, key string) []byte {
+	return []byte(value + "\x00" + key)
+}
+
+// indexed returns the record keys under value in an index, in key order
+func indexed(bkt *bolt.Bucket, value string) []string {
+	keys := []string{}
+	prefix := []byte(value + "\x00")
+	c := bkt.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, string(k[len(prefix):]))
+	}
+	return keys
+}
+
+// deleteAll deletes keys from a bucket once they have been collected, as deleting while iterating skips keys
+func deleteAll(bkt *bolt.Bucket, keys [][]byte) error {
+	for _, key := range keys {
+		if err := bkt.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getClient(tx *bolt.Tx, client_id string) (*Client, error) {
+	client := &Client{}
+	if err := getRecord(boltBucket(tx, clientCol), []byte(client_id), client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// putClient stores the client and its index entries, replacing any client with the same client ID
+// Returns errDuplicate if another client has the binding key
+func putClient(tx *bolt.Tx, client *Client) error {
+	if old, err := getClient(tx, client.Client_Id); err == nil {
+		if err = removeClient(tx, old); err != nil {
+			return err
+		}
+		if client.Id == "" {
+			client.Id = old.Id
+		}
+	}
+	if client.Id == "" {
+		client.Id = bson.NewObjectId()
+	}
+	if client.Binding_Key != "" {
+		bindings := boltBucket(tx, clientBindingIndex)
+		if bound := bindings.Get([]byte(client.Binding_Key)); bound != nil {
+			return errDuplicate
+		}
+		if err := bindings.Put([]byte(client.Binding_Key), []byte(client.Client_Id)); err != nil {
+			return err
+		}
+	}
+	if err := boltBucket(tx, clientAddressIndex).Put(indexKey(client.Address, client.Client_Id), []byte{}); err != nil {
+		return err
+	}
+	return putRecord(boltBucket(tx, clientCol), []byte(client.Client_Id), client)
+}
+
+// removeClient deletes the client and its index entries, but not its tokens
+func removeClient(tx *bolt.Tx, client *Client) error {
+	if client.Binding_Key != "" {
+		if err := boltBucket(tx, clientBindingIndex).Delete([]byte(client.Binding_Key)); err != nil {
+			return err
+		}
+	}
+	if err := boltBucket(tx, clientAddressIndex).Delete(indexKey(client.Address, client.Client_Id)); err != nil {
+		return err
+	}
+	return boltBucket(tx, clientCol).Delete([]byte(client.Client_Id))
+}
+
+// bindClient needs no retries: bbolt runs one write transaction at a time
+func (b *boltStorage) bindClient(address string) (*Client, bool, error) {
+	var client *Client
+	created := false
+	err := b.update(func(tx *bolt.Tx) error {
+		key := "address:" + address
+		if client_id := boltBucket(tx, clientBindingIndex).Get([]byte(key)); client_id != nil {
+			var err error
+			client, err = getClient(tx, string(client_id))
+			return err
+		}
+
+		client_id, err := random.GenerateRandomString(config.Tokens.Length)
+		if err != nil {
+			return err
+		}
+		if boltBucket(tx, clientCol).Get([]byte(client_id)) != nil {
+			return errDuplicate
+		}
+		client = &Client{Client_Id: client_id, Address: address, Binding_Key: key, Created: time.Now()}
+		created = true
+		return putClient(tx, client)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return client, created, nil
+}
+
+func (b *boltStorage) findClient(client_id string) (*Client, error) {
+	var client *Client
+	err := b.view(func(tx *bolt.Tx) error {
+		var err error
+		client, err = getClient(tx, client_id)
+		return err
+	})
+	return client, err
+}
+
+// listClients reads clients in client ID order, through the address index when filtering by address
+func (b *boltStorage) listClients(filter clientFilter) ([]Client, error) {
+	clients := []Client{}
+	err := b.view(func(tx *bolt.Tx) error {
+		matches := func(client *Client) bool {
+			if filter.Prefix != "" && !strings.HasPrefix(client.Client_Id, filter.Prefix) && !strings.HasPrefix(client.Client_Name, filter.Prefix) {
+				return false
+			}
+			return filter.Disabled == nil || client.Disabled == *filter.Disabled
+		}
+		full := func() bool { return filter.Limit > 0 && len(clients) >= filter.Limit }
+
+		if filter.Address != "" {
+			for _, client_id := range indexed(boltBucket(tx, clientAddressIndex), filter.Address) {
+				client, err := getClient(tx, client_id)
+				if err != nil {
+					return err
+				}
+				if matches(client) && !full() {
+					clients = append(clients, *client)
+				}
+			}
+			return nil
+		}
+		return boltBucket(tx, clientCol).ForEach(func(k, v []byte) error {
+			client := Client{}
+			if err := bson.Unmarshal(v, &client); err != nil {
+				return err
+			}
+			if matches(&client) && !full() {
+				clients = append(clients, client)
+			}
+			return nil
+		})
+	})
+	return clients, err
+}
+
+func (b *boltStorage) insertClient(client *Client) error {
+	return b.update(func(tx *bolt.Tx) error {
+		if boltBucket(tx, clientCol).Get([]byte(client.Client_Id)) != nil {
+			return errDuplicate
+		}
+		return putClient(tx, client)
+	})
+}
+
+func (b *boltStorage) saveClient(client *Client) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return putClient(tx, client)
+	})
+}
+
+// deleteClient removes the client and its tokens in one transaction
+func (b *boltStorage) deleteClient(client_id string) (int, error) {
+	removed := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		client, err := getClient(tx, client_id)
+		if err != nil {
+			return err
+		}
+		if err = removeClient(tx, client); err != nil {
+			return err
+		}
+		removed, err = removeTokenKeys(tx, indexed(boltBucket(tx, clientTokenIndex), client_id), tokenFilter{})
+		return err
+	})
+	return removed, err
+}
+
+func getToken(tx *bolt.Tx, id string) (*AccessToken, error) {
+	accessToken := &AccessToken{}
+	if err := getRecord(boltBucket(tx, accessTokenCol), []byte(id), accessToken); err != nil {
+		return nil, err
+	}
+	return accessToken, nil
+}
+
+// putToken stores the token, hashed by GetBSON, and its index entries, replacing any token with the same ID
+// Returns errDuplicate if another token has the same access token value
+func putToken(tx *bolt.Tx, accessToken *AccessToken) error {
+	if accessToken.Id == "" {
+		accessToken.Id = bson.NewObjectId()
+	}
+	id := string(accessToken.Id)
+	if old, err := getToken(tx, id); err == nil {
+		if err = removeToken(tx, old); err != nil {
+			return err
+		}
+	}
+	//Truncated to the precision BSON keeps, so the expiry index key can be found again from the stored token
+	accessToken.Expires_At = accessToken.expiresAt().Truncate(time.Millisecond)
+
+	stored := accessToken.withHashes()
+	if stored.Access_Token_Hash != "" {
+		hashes := boltBucket(tx, tokenHashIndex)
+		if hashes.Get([]byte(stored.Access_Token_Hash)) != nil {
+			return errDuplicate
+		}
+		if err := hashes.Put([]byte(stored.Access_Token_Hash), []byte(id)); err != nil {
+			return err
+		}
+	}
+	for index, key := range map[string][]byte{
+		clientTokenIndex:  indexKey(stored.Client_Id, id),
+		addressTokenIndex: indexKey(stored.Address, id),
+		tokenExpiryIndex:  append(boltTime(stored.Expires_At), id...),
+	} {
+		if err := boltBucket(tx, index).Put(key, []byte{}); err != nil {
+			return err
+		}
+	}
+	return putRecord(boltBucket(tx, accessTokenCol), []byte(id), accessToken)
+}
+
+func removeToken(tx *bolt.Tx, stored *AccessToken) error {
+	id := string(stored.Id)
+	if stored.Access_Token_Hash != "" {
+		if err := boltBucket(tx, tokenHashIndex).Delete([]byte(stored.Access_Token_Hash)); err != nil {
+			return err
+		}
+	}
+	for index, key := range map[string][]byte{
+		clientTokenIndex:  indexKey(stored.Client_Id, id),
+		addressTokenIndex: indexKey(stored.Address, id),
+		tokenExpiryIndex:  append(boltTime(stored.Expires_At), id...),
+	} {
+		if err := boltBucket(tx, index).Delete(key); err != nil {
+			return err
+		}
+	}
+	return boltBucket(tx, accessTokenCol).Delete([]byte(id))
+}
+
+// tokenKeys returns the IDs of the tokens that may match the filter, through the narrowest index, newest first
+func tokenKeys(tx *bolt.Tx, filter tokenFilter) []string {
+	keys := []string{}
+	if filter.Ids != nil {
+		for _, id := range filter.Ids {
+			keys = append(keys, string(id))
+		}
+	} else if filter.Client_Id != "" {
+		keys = indexed(boltBucket(tx, clientTokenIndex), filter.Client_Id)
+	} else if filter.Address != "" {
+		keys = indexed(boltBucket(tx, addressTokenIndex), filter.Address)
+	} else {
+		boltBucket(tx, accessTokenCol).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return keys
+}
+
+// matches checks the fields tokenKeys did not select the token by
+func (filter tokenFilter) matches(accessToken *AccessToken) bool {
+	return (filter.Client_Id == "" || accessToken.Client_Id == filter.Client_Id) &&
+		(filter.Address == "" || accessToken.Address == filter.Address)
+}
+
+// removeTokenKeys removes the tokens with the keys that match the filter, returning how many were removed
+func removeTokenKeys(tx *bolt.Tx, keys []string, filter tokenFilter) (int, error) {
+	removed := 0
+	for _, key := range keys {
+		accessToken, err := getToken(tx, key)
+		if err == errNotFound || (err == nil && !filter.matches(accessToken)) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if err = removeToken(tx, accessToken); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (b *boltStorage) insertToken(accessToken *AccessToken, keep int) (int, error) {
+	removed := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		if accessToken.Id != "" && boltBucket(tx, accessTokenCol).Get([]byte(accessToken.Id)) != nil {
+			return errDuplicate
+		}
+		if err := putToken(tx, accessToken); err != nil {
+			return err
+		}
+		if keep <= 0 {
+			return nil
+		}
+		filter := tokenFilter{Client_Id: accessToken.Client_Id}
+		keys := tokenKeys(tx, filter)
+		if len(keys) <= keep {
+			return nil
+		}
+		var err error
+		removed, err = removeTokenKeys(tx, keys[keep:], filter)
+		return err
+	})
+	return removed, err
+}
+
+func (b *boltStorage) findToken(value string) (*AccessToken, error) {
+	var accessToken *AccessToken
+	err := b.view(func(tx *bolt.Tx) error {
+		id := boltBucket(tx, tokenHashIndex).Get([]byte(hashToken(value)))
+		if id == nil {
+			return errNotFound
+		}
+		var err error
+		accessToken, err = getToken(tx, string(id))
+		if err == nil && !accessToken.Expires_At.After(time.Now()) {
+			err = errNotFound
+		}
+		return err
+	})
+	return accessToken, err
+}
+
+func (b *boltStorage) listTokens(filter tokenFilter, limit int) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	err := b.view(func(tx *bolt.Tx) error {
+		for _, key := range tokenKeys(tx, filter) {
+			if limit > 0 && len(tokens) >= limit {
+				return nil
+			}
+			accessToken, err := getToken(tx, key)
+			if err == errNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if filter.matches(accessToken) {
+				tokens = append(tokens, *accessToken)
+			}
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+func (b *boltStorage) removeTokens(filter tokenFilter) (int, error) {
+	removed := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		var err error
+		removed, err = removeTokenKeys(tx, tokenKeys(tx, filter), filter)
+		return err
+	})
+	return removed, err
+}
+
+func (b *boltStorage) saveToken(accessToken *AccessToken) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return putToken(tx, accessToken)
+	})
+}
+
+func (b *boltStorage) countTokens(ctx context.Context) (map[string]int, error) {
+	counts := map[string]int{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return boltBucket(tx, accessTokenCol).ForEach(func(k, v []byte) error {
+			accessToken := AccessToken{}
+			if err := bson.Unmarshal(v, &accessToken); err != nil {
+				return err
+			}
+			counts[accessToken.Token_Type]++
+			return nil
+		})
+	})
+	return counts, err
+}
+
+func (b *boltStorage) insertPushedRequest(pushed *PushedRequest) error {
+	return b.update(func(tx *bolt.Tx) error {
+		requests := boltBucket(tx, pushedRequestCol)
+		if requests.Get([]byte(pushed.Request_Uri)) != nil {
+			return errDuplicate
+		}
+		return putRecord(requests, []byte(pushed.Request_Uri), pushed)
+	})
+}
+
+func (b *boltStorage) findPushedRequest(requestUri string) (*PushedRequest, error) {
+	pushed := &PushedRequest{}
+	err := b.view(func(tx *bolt.Tx) error {
+		err := getRecord(boltBucket(tx, pushedRequestCol), []byte(requestUri), pushed)
+		if err == nil && (pushed.Used || !pushed.Expires.After(time.Now())) {
+			err = errNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pushed, nil
+}
+
+func (b *boltStorage) usePushedRequest(requestUri string) (*PushedRequest, error) {
+	pushed := &PushedRequest{}
+	err := b.update(func(tx *bolt.Tx) error {
+		requests := boltBucket(tx, pushedRequestCol)
+		err := getRecord(requests, []byte(requestUri), pushed)
+		if err != nil {
+			return err
+		}
+		if pushed.Used || !pushed.Expires.After(time.Now()) {
+			return errNotFound
+		}
+		pushed.Used = true
+		return putRecord(requests, []byte(requestUri), pushed)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pushed, nil
+}
+
+func (b *boltStorage) insertDPoPNonce(nonce string, created time.Time) error {
+	return b.update(func(tx *bolt.Tx) error {
+		return boltBucket(tx, dpopNonceCol).Put([]byte(nonce), boltTime(created))
+	})
+}
+
+func (b *boltStorage) dpopNonceIssued(nonce string, oldest time.Time) (bool, error) {
+	issued := false
+	err := b.view(func(tx *bolt.Tx) error {
+		created := boltBucket(tx, dpopNonceCol).Get([]byte(nonce))
+		issued = created != nil && bytes.Compare(created, boltTime(oldest)) >= 0
+		return nil
+	})
+	return issued, err
+}
+
+// insertDPoPJti keys the proof by its ID, so a replayed proof is found before it is stored again
+func (b *boltStorage) insertDPoPJti(id string, created time.Time) error {
+	return b.update(func(tx *bolt.Tx) error {
+		jtis := boltBucket(tx, dpopJtiCol)
+		if jtis.Get([]byte(id)) != nil {
+			return errDuplicate
+		}
+		return jtis.Put([]byte(id), boltTime(created))
+	})
+}
+
+// insertRequestObjectJti keys the request object by client ID and jti, storing when it expires
+func (b *boltStorage) insertRequestObjectJti(id string, expires time.Time) error {
+	return b.update(func(tx *bolt.Tx) error {
+		jtis := boltBucket(tx, requestObjectJtiCol)
+		if jtis.Get([]byte(id)) != nil {
+			return errDuplicate
+		}
+		return jtis.Put([]byte(id), boltTime(expires))
+	})
+}
+
+// appendAudit reads the end of the log and appends in one write transaction, so no other append can come between
+func (b *boltStorage) appendAudit(entry *AuditEntry) error {
+	return b.update(func(tx *bolt.Tx) error {
+		entries := boltBucket(tx, auditCol)
+		last := &AuditEntry{}
+		if _, data := entries.Cursor().Last(); data != nil {
+			if err := bson.Unmarshal(data, last); err != nil {
+				return err
+			}
+		}
+		entry.chain(last)
+		return putRecord(entries, boltSeq(entry.Seq), entry)
+	})
+}
+
+func (b *boltStorage) eachAuditEntry(fn func(entry *AuditEntry) error) error {
+	return b.view(func(tx *bolt.Tx) error {
+		return boltBucket(tx, auditCol).ForEach(func(k, v []byte) error {
+			entry := &AuditEntry{}
+			if err := bson.Unmarshal(v, entry); err != nil {
+				return err
+			}
+			return fn(entry)
+		})
+	})
+}
+
+func (b *boltStorage) rateLimits() limiterStore {
+	return &boltLimiter{storage: b}
+}
+
+// sweep deletes the records that have expired by now, as TTL indexes do in MongoDB
+// Returns the number of records deleted
+func (b *boltStorage) sweep(now time.Time) (int, error) {
+	deleted := 0
+	err := b.update(func(tx *bolt.Tx) error {
+		//Tokens are read through the expiry index, which holds the earliest first
+		expired := []string{}
+		c := boltBucket(tx, tokenExpiryIndex).Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], boltTime(now)) <= 0; k, _ = c.Next() {
+			expired = append(expired, string(k[8:]))
+		}
+		removed, err := removeTokenKeys(tx, expired, tokenFilter{})
+		deleted += removed
+		if err != nil {
+			return err
+		}
+
+		for _, expiry := range []struct {
+			bucket  string
+			expired func(v []byte) (bool, error)
+		}{
+			{pushedRequestCol, func(v []byte) (bool, error) {
+				pushed := PushedRequest{}
+				err := bson.Unmarshal(v, &pushed)
+				return !pushed.Expires.After(now), err
+			}},
+			{dpopNonceCol, func(v []byte) (bool, error) {
+				return bytes.Compare(v, boltTime(now.Add(-time.Duration(config.DPoP.Nonce_Lifetime)*time.Second))) <= 0, nil
+			}},
+			{dpopJtiCol, func(v []byte) (bool, error) {
+				return bytes.Compare(v, boltTime(now.Add(-dpopJtiLifetime))) <= 0, nil
+			}},
+			{requestObjectJtiCol, func(v []byte) (bool, error) {
+				return bytes.Compare(v, boltTime(now)) <= 0, nil
+			}},
+			{rateLimitCol, func(v []byte) (bool, error) {
+				limit := bucket{}
+				err := bson.Unmarshal(v, &limit)
+				return !limit.Expires.After(now), err
+			}},
+			{lockoutCol, func(v []byte) (bool, error) {
+				l := lockout{}
+				err := bson.Unmarshal(v, &l)
+				return !l.Expires.After(now), err
+			}},
+		} {
+			keys := [][]byte{}
+			bkt := tx.Bucket([]byte(expiry.bucket))
+			err := bkt.ForEach(func(k, v []byte) error {
+				done, err := expiry.expired(v)
+				if done && err == nil {
+					keys = append(keys, append([]byte{}, k...))
+				}
+				return err
+			})
+			if err == nil {
+				err = deleteAll(bkt, keys)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", expiry.bucket, err)
+			}
+			deleted += len(keys)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// backup writes a consistent copy of the file to w while requests continue to be served
+// The copy can be used as database.url to restore it, or to run verify-audit
+func (b *boltStorage) backup(w io.Writer, size func(int64)) (int64, error) {
+	var written int64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		size(tx.Size())
+		var err error
+		written, err = tx.WriteTo(w)
+		return err
+	})
+	return written, err
+}
+
+// appliedBoltMigrations returns the recorded migration versions
+func appliedBoltMigrations(tx *bolt.Tx) (map[int]bool, error) {
+	applied := map[int]bool{}
+	records := boltBucket(tx, migrationCol)
+	if records == nil {
+		return applied, nil
+	}
+	err := records.ForEach(func(k, v []byte) error {
+		applied[int(binary.BigEndian.Uint64(k))] = true
+		return nil
+	})
+	return applied, err
+}
+
+// prepare applies the pending migrations in one transaction, so a failure leaves the file as it was
+// A dry run reads the file without changing it
+func (b *boltStorage) prepare(report io.Writer, dryRun bool) error {
+	results := []migrationResult{}
+	migrate := func(tx *bolt.Tx) error {
+		applied, err := appliedBoltMigrations(tx)
+		if err != nil {
+			return err
+		}
+		records := boltBucket(tx, migrationCol)
+		if !dryRun && records == nil {
+			if records, err = tx.CreateBucket([]byte(migrationCol)); err != nil {
+				return err
+			}
+		}
+		for _, m := range boltMigrations {
+			result := migrationResult{Version: m.version, Name: m.name, Action: "already applied"}
+			if !applied[m.version] && dryRun {
+				result.Action = "pending"
+			} else if !applied[m.version] {
+				err = m.apply(tx)
+				if err == nil {
+					err = putRecord(records, boltSeq(int64(m.version)), appliedMigration{Version: m.version, Name: m.name, Applied: time.Now()})
+				}
+				if err != nil {
+					return fmt.Errorf("migration %d %s: %s", m.version, m.name, err)
+				}
+				result.Action = "applied"
+			}
+			results = append(results, result)
+		}
+		return nil
+	}
+
+	var err error
+	if dryRun {
+		err = b.db.View(migrate)
+	} else {
+		err = b.db.Update(migrate)
+	}
+	if err != nil {
+		return err
+	}
+	reportMigrations(report, migrationCol, results)
+	return nil
+}
+
+func (b *boltStorage) pendingMigrations(ctx context.Context) ([]string, error) {
+	pending := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		applied, err := appliedBoltMigrations(tx)
+		for _, m := range boltMigrations {
+			if !applied[m.version] {
+				pending = append(pending, fmt.Sprintf("%d %s", m.version, m.name))
+			}
+		}
+		return err
+	})
+	return pending, err
+}
+
+// ping checks the file is still open
+func (b *boltStorage) ping(ctx context.Context) error {
+	return b.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+func (b *boltStorage) close() {
+	b.db.Close()
+}
+
+// boltLimiter keeps limits in the bbolt file, which only one instance can use, so they survive restarts
+type boltLimiter struct {
+	storage *boltStorage
+}
+
+func (limiter *boltLimiter) take(key string, perMinute int, burst int) (time.Duration, error) {
+	defer observeStorage("rate_limit", time.Now())
+	var wait time.Duration
+	err := limiter.storage.update(func(tx *bolt.Tx) error {
+		buckets := tx.Bucket([]byte(rateLimitCol))
+		b := &bucket{Key: key}
+		if err := getRecord(buckets, []byte(key), b); err != nil && err != errNotFound {
+			return err
+		}
+		wait = b.refill(time.Now().Truncate(time.Millisecond), perMinute, burst)
+		if wait > 0 {
+			return nil
+		}
+		return putRecord(buckets, []byte(key), b)
+	})
+	return wait, err
+}
+
+func (limiter *boltLimiter) locked(key string) (time.Duration, error) {
+	l := &lockout{}
+	err := limiter.storage.view(func(tx *bolt.Tx) error {
+		return getRecord(tx.Bucket([]byte(lockoutCol)), []byte(key), l)
+	})
+	if err == errNotFound {
+		return 0, nil
+	}
+	return positive(time.Until(l.Locked_Until)), err
+}
+
+func (limiter *boltLimiter) fail(key string) (time.Duration, error) {
+	var duration time.Duration
+	err := limiter.storage.update(func(tx *bolt.Tx) error {
+		lockouts := tx.Bucket([]byte(lockoutCol))
+		l := &lockout{Key: key}
+		if err := getRecord(lockouts, []byte(key), l); err != nil && err != errNotFound {
+			return err
+		}
+		duration = l.fail(time.Now().Truncate(time.Millisecond))
+		return putRecord(lockouts, []byte(key), l)
+	})
+	return duration, err
+}
+
+func (limiter *boltLimiter) reset(key string) error {
+	return limiter.storage.update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(lockoutCol)).Delete([]byte(key))
+	})
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the authService configuration
+// Each setting is loaded from its default, then the config file, then its AUTH_* environment
+// variable, then its flag, with later sources taking precedence
+// Settings tagged secret are redacted when the configuration is printed
+type Config struct {
+	Listen         string              `yaml:"listen" env:"AUTH_LISTEN" flag:"listen" usage:"address to listen on"`
+	Issuer         string              `yaml:"issuer" env:"AUTH_ISSUER" flag:"issuer" usage:"URL identifying this server"`
+	Server         ServerConfig        `yaml:"server"`
+	Database       DatabaseConfig      `yaml:"database"`
+	Tokens         TokenConfig         `yaml:"tokens"`
+	DPoP           DPoPConfig          `yaml:"dpop"`
+	PAR            PARConfig           `yaml:"par"`
+	Request_Object RequestObjectConfig `yaml:"request_object"`
+	Registration   RegistrationConfig  `yaml:"registration"`
+	TLS            TLSConfig           `yaml:"tls"`
+	Health         HealthConfig        `yaml:"health"`
+	Metrics        MetricsConfig       `yaml:"metrics"`
+	Log            LogConfig           `yaml:"log"`
+	Audit          AuditConfig         `yaml:"audit"`
+	Rate_Limit     RateLimitConfig     `yaml:"rate_limit"`
+}
+
+type ServerConfig struct {
+	Read_Timeout     int      `yaml:"read_timeout" env:"AUTH_READ_TIMEOUT" flag:"read-timeout" usage:"seconds allowed to read a request"`
+	Write_Timeout    int      `yaml:"write_timeout" env:"AUTH_WRITE_TIMEOUT" flag:"write-timeout" usage:"seconds allowed to handle a request and write the response"`
+	Idle_Timeout     int      `yaml:"idle_timeout" env:"AUTH_IDLE_TIMEOUT" flag:"idle-timeout" usage:"seconds an idle keep-alive connection is kept open"`
+	Shutdown_Timeout int      `yaml:"shutdown_timeout" env:"AUTH_SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"seconds allowed for in-flight requests to finish on shutdown"`
+	Trusted_Proxies  []string `yaml:"trusted_proxies" env:"AUTH_TRUSTED_PROXIES" flag:"trusted-proxies" usage:"comma separated IPs or CIDRs of proxies whose Forwarded and X-Forwarded-For headers are believed"`
+}
+
+type DatabaseConfig struct {
+	Backend string `yaml:"backend" env:"AUTH_DATABASE_BACKEND" flag:"database-backend" usage:"where clients and tokens are stored: mongodb, postgres or bolt"`
+	Url     string `yaml:"url" env:"AUTH_DATABASE_URL" flag:"database-url" usage:"MongoDB address or mongodb:// URL, postgres:// URL, or path of the bolt file" secret:"url"`
+	Name    string `yaml:"name" env:"AUTH_DATABASE_NAME" flag:"database-name" usage:"MongoDB database name; not used by postgres or bolt"`
+}
+
+type TokenConfig struct {
+	Expires         int    `yaml:"expires" env:"AUTH_TOKEN_EXPIRES" flag:"token-expires" usage:"access token lifetime in seconds"`
+	Length          int    `yaml:"length" env:"AUTH_TOKEN_LENGTH" flag:"token-length" usage:"length of generated tokens, client IDs and secrets"`
+	Legacy_Format   bool   `yaml:"legacy_format" env:"AUTH_TOKEN_LEGACY_FORMAT" flag:"token-legacy-format" usage:"accept access tokens without a type prefix and checksum, as issued by earlier versions"`
+	Pepper          string `yaml:"pepper" env:"AUTH_TOKEN_PEPPER" flag:"token-pepper" usage:"key for the HMAC tokens are stored as; keep it out of the database and the same on every instance" secret:"true"`
+	Allow_No_Pepper bool   `yaml:"allow_no_pepper" env:"AUTH_TOKEN_ALLOW_NO_PEPPER" flag:"token-allow-no-pepper" usage:"start without tokens.pepper, storing unkeyed token hashes; for development only"`
+	Max_Per_Client  int    `yaml:"max_per_client" env:"AUTH_TOKEN_MAX_PER_CLIENT" flag:"token-max-per-client" usage:"tokens kept per client; issuing another revokes the oldest"`
+}
+
+type DPoPConfig struct {
+	Nonce_Lifetime int  `yaml:"nonce_lifetime" env:"AUTH_DPOP_NONCE_LIFETIME" flag:"dpop-nonce-lifetime" usage:"DPoP nonce lifetime in seconds"`
+	Require_Nonce  bool `yaml:"require_nonce" env:"AUTH_DPOP_REQUIRE_NONCE" flag:"dpop-require-nonce" usage:"require a server nonce in DPoP proofs at the token endpoint"`
+}
+
+type PARConfig struct {
+	Lifetime int `yaml:"lifetime" env:"AUTH_PAR_LIFETIME" flag:"par-lifetime" usage:"pushed request_uri lifetime in seconds"`
+}
+
+type RequestObjectConfig struct {
+	Max_Lifetime int `yaml:"max_lifetime" env:"AUTH_REQUEST_OBJECT_MAX_LIFETIME" flag:"request-object-max-lifetime" usage:"longest accepted request object lifetime in seconds"`
+}
+
+type RegistrationConfig struct {
+	Initial_Access_Token string `yaml:"initial_access_token" env:"AUTH_INITIAL_ACCESS_TOKEN" flag:"initial-access-token" usage:"token required to use /register, blank for open registration" secret:"true"`
+}
+
+type TLSConfig struct {
+	Cert_File       string   `yaml:"cert_file" env:"AUTH_TLS_CERT_FILE" flag:"tls-cert-file" usage:"PEM certificate chain, serves HTTPS when set"`
+	Key_File        string   `yaml:"key_file" env:"AUTH_TLS_KEY_FILE" flag:"tls-key-file" usage:"PEM private key for the certificate"`
+	Min_Version     string   `yaml:"min_version" env:"AUTH_TLS_MIN_VERSION" flag:"tls-min-version" usage:"lowest TLS version accepted, 1.2 or 1.3"`
+	Cipher_Suites   []string `yaml:"cipher_suites" env:"AUTH_TLS_CIPHER_SUITES" flag:"tls-cipher-suites" usage:"comma separated TLS 1.2 cipher suite names, blank for Go's defaults"`
+	Reload_Interval int      `yaml:"reload_interval" env:"AUTH_TLS_RELOAD_INTERVAL" flag:"tls-reload-interval" usage:"seconds between checks for a changed certificate or key"`
+	Redirect_Listen string   `yaml:"redirect_listen" env:"AUTH_TLS_REDIRECT_LISTEN" flag:"tls-redirect-listen" usage:"address to redirect plain HTTP to HTTPS from, blank to disable"`
+}
+
+type HealthConfig struct {
+	Check_Timeout  int `yaml:"check_timeout" env:"AUTH_HEALTH_CHECK_TIMEOUT" flag:"health-check-timeout" usage:"seconds each /readyz check may take before it fails"`
+	Shutdown_Delay int `yaml:"shutdown_delay" env:"AUTH_HEALTH_SHUTDOWN_DELAY" flag:"health-shutdown-delay" usage:"seconds /readyz reports shutting down before the listener closes"`
+}
+
+type MetricsConfig struct {
+	Enabled           bool   `yaml:"enabled" env:"AUTH_METRICS_ENABLED" flag:"metrics-enabled" usage:"serve Prometheus metrics at /metrics"`
+	Token             string `yaml:"token" env:"AUTH_METRICS_TOKEN" flag:"metrics-token" usage:"bearer token required to read /metrics, blank for none" secret:"true"`
+	Max_Client_Labels int    `yaml:"max_client_labels" env:"AUTH_METRICS_MAX_CLIENT_LABELS" flag:"metrics-max-client-labels" usage:"client IDs given their own metric label before the rest are counted as other"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level" env:"AUTH_LOG_LEVEL" flag:"log-level" usage:"lowest level logged: debug, info, warn or error"`
+	Format string `yaml:"format" env:"AUTH_LOG_FORMAT" flag:"log-format" usage:"log format: json or text"`
+}
+
+type AuditConfig struct {
+	Key string `yaml:"key" env:"AUTH_AUDIT_KEY" flag:"audit-key" usage:"key for the HMAC audit entries are chained with, blank to use tokens.pepper; keep it out of the database" secret:"true"`
+}
+
+type RateLimitConfig struct {
+	Enabled              bool   `yaml:"enabled" env:"AUTH_RATE_LIMIT_ENABLED" flag:"rate-limit-enabled" usage:"rate limit and lock out callers of the token, authorise, PAR, registration and admin endpoints"`
+	Store                string `yaml:"store" env:"AUTH_RATE_LIMIT_STORE" flag:"rate-limit-store" usage:"where limits are kept: memory for this instance only, or database to share them between instances"`
+	Client_Per_Minute    int    `yaml:"client_per_minute" env:"AUTH_RATE_LIMIT_CLIENT_PER_MINUTE" flag:"rate-limit-client-per-minute" usage:"token and PAR requests allowed per client ID each minute"`
+	Client_Burst         int    `yaml:"client_burst" env:"AUTH_RATE_LIMIT_CLIENT_BURST" flag:"rate-limit-client-burst" usage:"requests a client ID may make at once before its per-minute limit applies"`
+	Address_Per_Minute   int    `yaml:"address_per_minute" env:"AUTH_RATE_LIMIT_ADDRESS_PER_MINUTE" flag:"rate-limit-address-per-minute" usage:"requests allowed per source IP address each minute"`
+	Address_Burst        int    `yaml:"address_burst" env:"AUTH_RATE_LIMIT_ADDRESS_BURST" flag:"rate-limit-address-burst" usage:"requests an address may make at once before its per-minute limit applies"`
+	Authorise_Per_Minute int    `yaml:"authorise_per_minute" env:"AUTH_RATE_LIMIT_AUTHORISE_PER_MINUTE" flag:"rate-limit-authorise-per-minute" usage:"/authorise requests allowed per source IP address each minute"`
+	Authorise_Burst      int    `yaml:"authorise_burst" env:"AUTH_RATE_LIMIT_AUTHORISE_BURST" flag:"rate-limit-authorise-burst" usage:"/authorise requests an address may make at once before its per-minute limit applies"`
+	Lockout_Threshold    int    `yaml:"lockout_threshold" env:"AUTH_RATE_LIMIT_LOCKOUT_THRESHOLD" flag:"rate-limit-lockout-threshold" usage:"failed authentications allowed before the address, or the client at that address, is locked out"`
+	Lockout_Duration     int    `yaml:"lockout_duration" env:"AUTH_RATE_LIMIT_LOCKOUT_DURATION" flag:"rate-limit-lockout-duration" usage:"seconds of the first lockout, doubled by each further failure"`
+	Lockout_Max          int    `yaml:"lockout_max" env:"AUTH_RATE_LIMIT_LOCKOUT_MAX" flag:"rate-limit-lockout-max" usage:"longest lockout in seconds, and how long failures are remembered"`
+}
+
+// config is the running configuration; it holds the defaults until main loads the real one
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:         ":8080",
+		Issuer:         "http://127.0.0.1:8080",
+		Server:         ServerConfig{Read_Timeout: 10, Write_Timeout: 30, Idle_Timeout: 120, Shutdown_Timeout: 30},
+		Database:       DatabaseConfig{Backend: "mongodb", Url: "127.0.0.1", Name: "authDB"},
+		Tokens:         TokenConfig{Expires: 600, Length: 50, Legacy_Format: true, Max_Per_Client: 100},
+		DPoP:           DPoPConfig{Nonce_Lifetime: 300, Require_Nonce: true},
+		PAR:            PARConfig{Lifetime: 60},
+		Request_Object: RequestObjectConfig{Max_Lifetime: 3600},
+		TLS:            TLSConfig{Min_Version: "1.2", Reload_Interval: 30},
+		Health:         HealthConfig{Check_Timeout: 2},
+		Metrics:        MetricsConfig{Enabled: true, Max_Client_Labels: 100},
+		Log:            LogConfig{Level: "info", Format: "json"},
+		Rate_Limit: RateLimitConfig{Enabled: true, Store: "memory", Client_Per_Minute: 60, Client_Burst: 20,
+			Address_Per_Minute: 300, Address_Burst: 60, Authorise_Per_Minute: 6000, Authorise_Burst: 1000,
+			Lockout_Threshold: 5, Lockout_Duration: 30, Lockout_Max: 900},
+	}
+}
+
+// configField is a single setting found by walking the Config struct
+type configField struct {
+	value reflect.Value
+	field reflect.StructField
+}
+
+// commandOptions are the flags that choose what authService does, rather than how it is configured
+type commandOptions struct {
+	printConfig bool
+	migrateOnly bool
+	dryRun      bool
+}
+
+// loadConfig builds the configuration from the command line arguments, environment and config file
+// The config file is named by -config or AUTH_CONFIG
+// Returns the command options as the second value, such as whether to print the configuration instead of serving
+func loadConfig(args []string, stderr io.Writer) (*Config, commandOptions, error) {
+	cfg := defaultConfig()
+	fields := configFields(reflect.ValueOf(cfg).Elem())
+
+	flags := flag.NewFlagSet("authService", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configFile := flags.String("config", os.Getenv("AUTH_CONFIG"), "path to a YAML config file, or TOML if it ends in .toml")
+	printConfig := flags.Bool("print-config", false, "print the configuration with secrets redacted and exit")
+	migrateOnly := flags.Bool("migrate-only", false, "create indexes and run pending migrations, report what was done and exit")
+	dryRun := flags.Bool("dry-run", false, "with -migrate-only, report what would be done without changing anything")
+	flagValues := map[string]*string{}
+	flagFields := map[string]configField{}
+	for _, f := range fields {
+		name := f.field.Tag.Get("flag")
+		usage := fmt.Sprintf("%s (env %s, default %v)", f.field.Tag.Get("usage"), f.field.Tag.Get("env"), f.value.Interface())
+		flagValues[name] = flags.String(name, "", usage)
+		flagFields[name] = f
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, commandOptions{}, err
+	}
+	if *dryRun && !*migrateOnly {
+		return nil, commandOptions{}, errors.New("-dry-run can only be used with -migrate-only")
+	}
+
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err == nil && strings.EqualFold(filepath.Ext(*configFile), ".toml") {
+			data, err = tomlToYAML(data)
+		}
+		if err == nil {
+			err = yaml.UnmarshalStrict(data, cfg)
+		}
+		if err != nil {
+			return nil, commandOptions{}, fmt.Errorf("%s: %s", *configFile, err)
+		}
+	}
+
+	for _, f := range fields {
+		if value, ok := os.LookupEnv(f.field.Tag.Get("env")); ok {
+			err = setConfigField(f, value)
+			if err != nil {
+				return nil, commandOptions{}, fmt.Errorf("%s: %s", f.field.Tag.Get("env"), err)
+			}
+		}
+	}
+
+	flags.Visit(func(fl *flag.Flag) {
+		if f, ok := flagFields[fl.Name]; ok && err == nil {
+			err = setConfigField(f, *flagValues[fl.Name])
+			if err != nil {
+				err = fmt.Errorf("-%s: %s", fl.Name, err)
+			}
+		}
+	})
+	if err != nil {
+		return nil, commandOptions{}, err
+	}
+
+	return cfg, commandOptions{printConfig: *printConfig, migrateOnly: *migrateOnly, dryRun: *dryRun}, cfg.validate()
+}
+
+// validate checks every setting is usable, reporting all problems at once
+func (cfg *Config) validate() error {
+	problems := []string{}
+	if cfg.Listen == "" {
+		problems = append(problems, "listen must be set")
+	}
+	if u, err := url.Parse(cfg.Issuer); err != nil || !u.IsAbs() || u.RawQuery != "" || u.Fragment != "" {
+		problems = append(problems, "issuer must be an absolute URL without a query or fragment")
+	}
+	if cfg.Server.Read_Timeout <= 0 || cfg.Server.Write_Timeout <= 0 || cfg.Server.Idle_Timeout <= 0 || cfg.Server.Shutdown_Timeout <= 0 {
+		problems = append(problems, "server timeouts must be positive")
+	}
+	if cfg.Database.Backend != "mongodb" && cfg.Database.Backend != "postgres" && cfg.Database.Backend != "bolt" {
+		problems = append(problems, "database.backend must be mongodb, postgres or bolt")
+	}
+	if cfg.Database.Url == "" || (cfg.Database.Backend == "mongodb" && cfg.Database.Name == "") {
+		problems = append(problems, "database url and name must be set")
+	}
+	if cfg.Tokens.Expires <= 0 {
+		problems = append(problems, "tokens.expires must be positive")
+	}
+	if cfg.Tokens.Length < 32 {
+		problems = append(problems, "tokens.length must be at least 32")
+	}
+	if cfg.Tokens.Max_Per_Client <= 0 {
+		problems = append(problems, "tokens.max_per_client must be positive")
+	}
+	if cfg.DPoP.Nonce_Lifetime <= 0 || cfg.PAR.Lifetime <= 0 || cfg.Request_Object.Max_Lifetime <= 0 {
+		problems = append(problems, "dpop.nonce_lifetime, par.lifetime and request_object.max_lifetime must be positive")
+	}
+	if (cfg.TLS.Cert_File == "") != (cfg.TLS.Key_File == "") {
+		problems = append(problems, "tls.cert_file and tls.key_file must be set together")
+	}
+	if cfg.TLS.Redirect_Listen != "" && cfg.TLS.Cert_File == "" {
+		problems = append(problems, "tls.redirect_listen needs tls.cert_file")
+	}
+	if cfg.TLS.Reload_Interval <= 0 {
+		problems = append(problems, "tls.reload_interval must be positive")
+	}
+	if cfg.Health.Check_Timeout <= 0 || cfg.Health.Shutdown_Delay < 0 {
+		problems = append(problems, "health.check_timeout must be positive and health.shutdown_delay must not be negative")
+	}
+	if cfg.Metrics.Max_Client_Labels < 0 {
+		problems = append(problems, "metrics.max_client_labels must not be negative")
+	}
+	if _, ok := logLevels[cfg.Log.Level]; !ok || (cfg.Log.Format != "json" && cfg.Log.Format != "text") {
+		problems = append(problems, "log.level must be debug, info, warn or error and log.format must be json or text")
+	}
+	if cfg.Rate_Limit.Store != "memory" && cfg.Rate_Limit.Store != "database" {
+		problems = append(problems, "rate_limit.store must be memory or database")
+	}
+	if cfg.Rate_Limit.Client_Per_Minute <= 0 || cfg.Rate_Limit.Client_Burst <= 0 || cfg.Rate_Limit.Address_Per_Minute <= 0 || cfg.Rate_Limit.Address_Burst <= 0 ||
+		cfg.Rate_Limit.Authorise_Per_Minute <= 0 || cfg.Rate_Limit.Authorise_Burst <= 0 {
+		problems = append(problems, "rate_limit per-minute limits and bursts must be positive")
+	}
+	if cfg.Rate_Limit.Lockout_Threshold <= 0 || cfg.Rate_Limit.Lockout_Duration <= 0 || cfg.Rate_Limit.Lockout_Max < cfg.Rate_Limit.Lockout_Duration {
+		problems = append(problems, "rate_limit.lockout_threshold and lockout_duration must be positive and lockout_max at least lockout_duration")
+	}
+	if _, err := parseTrustedProxies(cfg.Server.Trusted_Proxies); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := newTLSConfig(cfg.TLS, nil); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// print writes the configuration as YAML with secrets redacted
+func (cfg *Config) print(w io.Writer) error {
+	redacted := *cfg
+	for _, f := range configFields(reflect.ValueOf(&redacted).Elem()) {
+		switch f.field.Tag.Get("secret") {
+		case "true":
+			if f.value.String() != "" {
+				f.value.SetString("REDACTED")
+			}
+		case "url":
+			f.value.SetString(redactURL(f.value.String()))
+		}
+	}
+
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// configFields lists the settings in a config struct, descending into nested structs
+func configFields(v reflect.Value) []configField {
+	fields := []configField{}
+	for i := 0; i < v.NumField(); i++ {
+		if v.Field(i).Kind() == reflect.Struct {
+			fields = append(fields, configFields(v.Field(i))...)
+		} else {
+			fields = append(fields, configField{value: v.Field(i), field: v.Type().Field(i)})
+		}
+	}
+	return fields
+}
+
+// setConfigField parses a flag or environment string into the setting
+// Lists are comma separated
+func setConfigField(f configField, value string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		f.value.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		f.value.SetBool(b)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		f.value.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("unsupported setting type")
+	}
+	return nil
+}
+
+// tomlToYAML converts a TOML config file to YAML, so both are read with the same keys and unknown keys are rejected
+func tomlToYAML(data []byte) ([]byte, error) {
+	settings := map[string]interface{}{}
+	err := toml.Unmarshal(data, &settings)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(settings)
+}
+
+// dsnPassword matches the password in a key=value connection string, quoted or not
+var dsnPassword = regexp.MustCompile(`(^|\s)password\s*=\s*('(\\.|[^'])*'|\S*)`)
+
+// redactURL hides the password in a mongodb:// or postgres:// style URL, or in a key=value connection string
+// such as "host=db password=secret"
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return dsnPassword.ReplaceAllString(value, "${1}password=REDACTED")
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	if query := u.Query(); query.Get("password") != "" {
+		query.Set("password", "REDACTED")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
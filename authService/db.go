@@ -0,0 +1,36 @@
+package main
+
+import (
+	"sync"
+
+	"gopkg.in/mgo.v2"
+)
+
+// dbSession is the connection pool shared by every request
+var dbSession *mgo.Session
+var dbMutex sync.Mutex
+
+// openDatabase returns a session from the pool, connecting to MongoDB on first use
+// Close the returned session to give its connection back to the pool
+func openDatabase() (*mgo.Session, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	if dbSession == nil {
+		session, err := mgo.Dial(config.Database.Url)
+		if err != nil {
+			return nil, err
+		}
+		dbSession = session
+	}
+	return dbSession.Copy(), nil
+}
+
+// closeDatabase closes the pool once requests have finished with it
+func closeDatabase() {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	if dbSession != nil {
+		dbSession.Close()
+		dbSession = nil
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/imryano/OAuth/authPackage"
+	"github.com/imryano/utils/random"
+)
+
+const dpopNonceCol string = "dpopNonces"
+const dpopJtiCol string = "dpopJtis"
+
+// errUseDPoPNonce tells the client to retry with the nonce in the DPoP-Nonce header
+var errUseDPoPNonce = errors.New("use_dpop_nonce")
+
+type DPoPNonce struct {
+	Nonce   string    `bson:"_id"`
+	Created time.Time `bson:"created"`
+}
+
+type DPoPJti struct {
+	Id      string    `bson:"_id"`
+	Created time.Time `bson:"created"`
+}
+
+// dpopMethodHeader and dpopURLHeader carry the method and URL of the request a resource server received a DPoP
+// proof with, when it sends that proof on to /authorise
+const dpopMethodHeader string = "DPoP-Method"
+const dpopURLHeader string = "DPoP-URL"
+
+// verifyDPoPRequest verifies the DPoP header of a request made to this service
+// accessToken is blank at the token endpoint and the presented token when authorising
+// Returns the verified proof, or an error if the proof is missing, invalid or replayed
+func verifyDPoPRequest(r *http.Request, accessToken string, requireNonce bool) (*authorisation.DPoPProof, error) {
+	return verifyDPoPProof(r, r.Method, requestURL(r), accessToken, requireNonce)
+}
+
+// verifyDPoPAuthorise verifies the DPoP header of an /authorise request
+// A resource server sends the proof it received, with that request's method and URL in the DPoP-Method and DPoP-URL
+// headers; the proof is signed by the token's key and covers the token, so only its holder can have made it
+func verifyDPoPAuthorise(r *http.Request, accessToken string) (*authorisation.DPoPProof, error) {
+	htm, htu := r.Header.Get(dpopMethodHeader), r.Header.Get(dpopURLHeader)
+	if htm == "" && htu == "" {
+		return verifyDPoPRequest(r, accessToken, false)
+	} else if htm == "" || htu == "" {
+		return nil, errors.New(dpopMethodHeader + " and " + dpopURLHeader + " must be sent together")
+	}
+	return verifyDPoPProof(r, htm, htu, accessToken, false)
+}
+
+// verifyDPoPProof verifies the request's DPoP header as a proof for the method htm and URL htu, and records it against replay
+func verifyDPoPProof(r *http.Request, htm string, htu string, accessToken string, requireNonce bool) (*authorisation.DPoPProof, error) {
+	headers := r.Header["Dpop"]
+	if len(headers) != 1 {
+		return nil, errors.New("exactly one DPoP header is required")
+	}
+
+	proof, err := authorisation.VerifyDPoPProof(headers[0], htm, htu, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if requireNonce && !checkDPoPNonce(proof.Nonce) {
+		return nil, errUseDPoPNonce
+	}
+
+	err = store.insertDPoPJti(proof.Jkt+":"+proof.Jti, time.Now())
+	if err == errDuplicate {
+		return nil, errors.New("DPoP proof has already been used")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return proof, nil
+}
+
+// issueDPoPNonce creates a nonce and records it so it can be checked later
+// Returns blank string if there is a failure
+func issueDPoPNonce() string {
+	nonce, err := random.GenerateRandomString(32)
+	if err == nil {
+		err = store.insertDPoPNonce(nonce, time.Now())
+		if err == nil {
+			return nonce
+		}
+	}
+	logger.Warn("Could not issue DPoP nonce", "error", err)
+	return ""
+}
+
+// CheckDPoPNonce checks the nonce was issued by this service and has not expired
+func checkDPoPNonce(nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+	oldest := time.Now().Add(-time.Duration(config.DPoP.Nonce_Lifetime) * time.Second)
+	issued, err := store.dpopNonceIssued(nonce, oldest)
+	return issued && err == nil
+}
+
+// writeDPoPError responds to a request whose DPoP proof was rejected
+// A fresh nonce is always supplied so the client can retry
+func writeDPoPError(w http.ResponseWriter, err error) {
+	if nonce := issueDPoPNonce(); nonce != "" {
+		w.Header().Set("DPoP-Nonce", nonce)
+	}
+	if err == errUseDPoPNonce {
+		writeOAuthError(w, http.StatusBadRequest, "use_dpop_nonce", "Authorization server requires nonce in DPoP proof")
+	} else {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+	}
+}
+
+// requestURL rebuilds the absolute URL (without query) a request was sent to
+// The scheme and host are the issuer's, as clients reach this service at that URL, through a proxy terminating TLS or
+// not, and the Host header is the client's to choose
+func requestURL(r *http.Request) string {
+	issuer, err := url.Parse(config.Issuer)
+	if err != nil {
+		return ""
+	}
+	return issuer.Scheme + "://" + issuer.Host + r.URL.Path
+}
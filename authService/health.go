@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CheckStatus is the result of one readiness check
+type CheckStatus struct {
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Duration_Ms int64  `json:"duration_ms"`
+}
+
+// HealthStatus is returned by /healthz and /readyz
+type HealthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckStatus `json:"checks,omitempty"`
+}
+
+// readinessCheck reports whether a dependency is ready, returning promptly once ctx is done
+type readinessCheck func(ctx context.Context) error
+
+var readinessChecks = map[string]readinessCheck{"database": checkDatabase}
+var readinessMutex sync.Mutex
+
+// shuttingDown is set once graceful shutdown starts, so /readyz takes the server out of rotation
+var shuttingDown int32
+
+// addReadinessCheck makes /readyz depend on another check
+func addReadinessCheck(name string, check readinessCheck) {
+	readinessMutex.Lock()
+	defer readinessMutex.Unlock()
+	readinessChecks[name] = check
+}
+
+// healthz reports the process is up and serving requests
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &HealthStatus{Status: "ok"})
+}
+
+// readyz runs every readiness check in parallel, each within health.check_timeout
+// Responds 503 if any check fails or the server is shutting down
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		writeJSON(w, http.StatusServiceUnavailable, &HealthStatus{Status: "shutting_down"})
+		return
+	}
+
+	status := runReadinessChecks(r.Context(), time.Duration(config.Health.Check_Timeout)*time.Second)
+	if status.Status != "ok" {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func runReadinessChecks(ctx context.Context, timeout time.Duration) *HealthStatus {
+	readinessMutex.Lock()
+	checks := map[string]readinessCheck{}
+	for name, check := range readinessChecks {
+		checks[name] = check
+	}
+	readinessMutex.Unlock()
+
+	status := &HealthStatus{Status: "ok", Checks: map[string]CheckStatus{}}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check readinessCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			begin := time.Now()
+			err := runCheck(checkCtx, check)
+			result := CheckStatus{Status: "ok", Duration_Ms: time.Since(begin).Milliseconds()}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+
+			mutex.Lock()
+			status.Checks[name] = result
+			if err != nil {
+				status.Status = "fail"
+			}
+			mutex.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return status
+}
+
+// runCheck runs check, giving up when ctx is done even if the check does not
+func runCheck(ctx context.Context, check readinessCheck) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- check(ctx)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.New("timed out")
+	}
+}
+
+// checkDatabase checks the storage can reach its database
+func checkDatabase(ctx context.Context) error {
+	return store.ping(ctx)
+}
+
+// certificateCheck reports whether the TLS certificate is loaded and currently valid
+func certificateCheck(reloader *certReloader) readinessCheck {
+	return func(ctx context.Context) error {
+		cert, _ := reloader.GetCertificate(nil)
+		if cert == nil || len(cert.Certificate) == 0 {
+			return errors.New("no certificate loaded")
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		if time.Now().After(leaf.NotAfter) {
+			return errors.New("certificate expired at " + leaf.NotAfter.Format(time.RFC3339))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// dpopJtiLifetime is how long a DPoP proof's jti is remembered; proofs are accepted up to five minutes
+// either side of the current time, so a jti cannot be replayed once it is ten minutes old
+const dpopJtiLifetime time.Duration = 10 * time.Minute
+
+// collectionIndex is an index authService needs on a collection
+type collectionIndex struct {
+	collection string
+	index      mgo.Index
+}
+
+// indexChange reports what ensureIndexes did with one index: created, updated or exists
+// In a dry run the actions are "would create" and "would update"
+type indexChange struct {
+	Collection string
+	Index      string
+	Action     string
+}
+
+// requiredIndexes lists every index the service relies on
+// Indexes with ExpireAfter are TTL indexes; MongoDB removes documents that long after the indexed time
+func requiredIndexes() []collectionIndex {
+	return []collectionIndex{
+		{clientCol, mgo.Index{Key: []string{"client_id"}, Unique: true}},
+		{clientCol, mgo.Index{Key: []string{"binding_key"}, Unique: true, Sparse: true}},
+		{clientCol, mgo.Index{Key: []string{"address"}}},
+		{accessTokenCol, mgo.Index{Key: []string{"access_token_hash"}, Unique: true, Sparse: true}},
+		{accessTokenCol, mgo.Index{Key: []string{"client_id", "address"}}},
+		{accessTokenCol, mgo.Index{Key: []string{"expires_at"}, ExpireAfter: time.Second}},
+		{pushedRequestCol, mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}},
+		{dpopNonceCol, mgo.Index{Key: []string{"created"}, ExpireAfter: time.Duration(config.DPoP.Nonce_Lifetime) * time.Second}},
+		{dpopJtiCol, mgo.Index{Key: []string{"created"}, ExpireAfter: dpopJtiLifetime}},
+		{requestObjectJtiCol, mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}},
+		{rateLimitCol, mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}},
+		{lockoutCol, mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second}},
+	}
+}
+
+// ensureIndexes creates any required index that is missing and updates TTL indexes whose expiry has changed
+// Returns what was done with each index, up to the first failure; a dry run only reports what would be done
+func ensureIndexes(db *mgo.Database, dryRun bool) ([]indexChange, error) {
+	changes := []indexChange{}
+	existing := map[string][]mgo.Index{}
+	for _, required := range requiredIndexes() {
+		c := db.C(required.collection)
+		if _, ok := existing[required.collection]; !ok {
+			//A collection that does not exist yet has no indexes
+			existing[required.collection], _ = c.Indexes()
+		}
+
+		change := indexChange{Collection: required.collection, Index: strings.Join(required.index.Key, ",")}
+		current, found := findIndex(existing[required.collection], required.index.Key)
+		switch {
+		case !found && dryRun:
+			change.Action = "would create"
+		case !found:
+			if err := c.EnsureIndex(required.index); err != nil {
+				return changes, fmt.Errorf("%s index %s: %s", change.Collection, change.Index, err)
+			}
+			change.Action = "created"
+		case current.ExpireAfter != required.index.ExpireAfter && dryRun:
+			change.Action = "would update"
+		case current.ExpireAfter != required.index.ExpireAfter:
+			err := db.Run(bson.D{{Name: "collMod", Value: required.collection}, {Name: "index", Value: bson.M{
+				"name":               current.Name,
+				"expireAfterSeconds": int(required.index.ExpireAfter / time.Second),
+			}}}, nil)
+			if err != nil {
+				return changes, fmt.Errorf("%s index %s: %s", change.Collection, change.Index, err)
+			}
+			change.Action = "updated"
+		default:
+			change.Action = "exists"
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// findIndex finds the index on exactly the given keys
+func findIndex(indexes []mgo.Index, key []string) (mgo.Index, bool) {
+	for _, index := range indexes {
+		if strings.Join(index.Key, ",") == strings.Join(key, ",") {
+			return index, true
+		}
+	}
+	return mgo.Index{}, false
+}
+
+// setTokenExpiry gives tokens stored by earlier versions an expires_at, so the TTL index removes them
+// Returns the number of tokens updated, or in a dry run the number that would be
+func setTokenExpiry(c *mgo.Collection, dryRun bool) (int, error) {
+	query := c.Find(bson.M{"expires_at": bson.M{"$exists": false}})
+	if dryRun {
+		return query.Count()
+	}
+	updated := 0
+	stored := &AccessToken{}
+	iter := query.Iter()
+	for iter.Next(stored) {
+		err := c.UpdateId(stored.Id, bson.M{"$set": bson.M{"expires_at": stored.expiresAt()}})
+		if err != nil {
+			iter.Close()
+			return updated, err
+		}
+		updated++
+		stored = &AccessToken{}
+	}
+	return updated, iter.Close()
+}
+
+// setClientBindingKeys binds each address to the oldest client /getclientid gave it before binding keys were stored,
+// so /getclientid returns that client again instead of creating another
+// Registered clients choose their own address, so only clients with neither a registration token nor a secret are
+// bound; an address that already has a bound client keeps it
+// Returns the number of clients bound, or in a dry run the number that would be
+func setClientBindingKeys(c *mgo.Collection, dryRun bool) (int, error) {
+	iter := c.Find(bson.M{
+		"binding_key":             bson.M{"$exists": false},
+		"registration_token_hash": bson.M{"$exists": false},
+		"client_secret_hash":      bson.M{"$exists": false},
+		"address":                 bson.M{"$nin": []string{"", anyAddress}},
+	}).Sort("_id").Select(bson.M{"address": 1}).Iter()
+	bound := 0
+	seen := map[string]bool{}
+	stored := struct {
+		Id      bson.ObjectId `bson:"_id"`
+		Address string        `bson:"address"`
+	}{}
+	for iter.Next(&stored) {
+		key := "address:" + stored.Address
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if dryRun {
+			existing, err := c.Find(bson.M{"binding_key": key}).Count()
+			if err != nil {
+				iter.Close()
+				return bound, err
+			}
+			if existing == 0 {
+				bound++
+			}
+			continue
+		}
+		err := c.UpdateId(stored.Id, bson.M{"$set": bson.M{"binding_key": key}})
+		if mgo.IsDup(err) {
+			continue
+		} else if err != nil {
+			iter.Close()
+			return bound, err
+		}
+		bound++
+	}
+	return bound, iter.Close()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/imryano/OAuth/authPackage"
+)
+
+// requestObjectMaxSize caps the size of a request object fetched from a request_uri
+const requestObjectMaxSize = 64 * 1024
+
+const requestObjectJtiCol string = "requestObjectJtis"
+
+// RequestObjectJti records a request object that has been used until it expires, so it cannot be replayed
+type RequestObjectJti struct {
+	Id      string    `bson:"_id"`
+	Expires time.Time `bson:"expires"`
+}
+
+// RequestObjectClaims are the claims of a signed request object (RFC 9101)
+type RequestObjectClaims struct {
+	Iss           string   `json:"iss"`
+	Aud           audience `json:"aud"`
+	Exp           int64    `json:"exp"`
+	Nbf           int64    `json:"nbf,omitempty"`
+	Jti           string   `json:"jti"`
+	Response_Type string   `json:"response_type"`
+	Client_Id     string   `json:"client_id"`
+	State         string   `json:"state"`
+	Address       string   `json:"address"`
+	Resource      audience `json:"resource,omitempty"`
+	Scope         string   `json:"scope,omitempty"`
+}
+
+// audience is a JWT aud claim, which may be a single string or an array
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*aud = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*aud = audience(list)
+	return err
+}
+
+func (aud audience) contains(value string) bool {
+	return containsString(aud, value)
+}
+
+// resolveRequestObject replaces the request parameters with those in a signed request object
+// The object is taken from the request parameter, or fetched from a request_uri the client registered
+// Plain parameters that conflict with the signed ones are rejected, and the signed ones replace them (RFC 9101 section 5)
+func (atr *AccessTokenRequest) resolveRequestObject() error {
+	if atr.Signed {
+		//Already verified when it was pushed to /par
+		return nil
+	}
+	if atr.Request == "" && atr.Request_Uri == "" {
+		if clientRequiresSignedRequest(atr.Client_Id) {
+			return errors.New("client must use a signed request object")
+		}
+		return nil
+	}
+
+	client, err := store.findClient(atr.Client_Id)
+	if err != nil {
+		return errors.New("unknown client")
+	}
+
+	if atr.Request_Uri != "" {
+		if atr.Request != "" {
+			return errors.New("request and request_uri cannot both be used")
+		}
+		if !containsString(client.Request_Uris, atr.Request_Uri) {
+			return errors.New("request_uri is not registered for this client")
+		}
+		atr.Request, err = fetchRequestObject(atr.Request_Uri)
+		if err != nil {
+			return err
+		}
+		atr.Request_Uri = ""
+	}
+
+	claims, err := verifyRequestObject(atr.Request, client)
+	if err != nil {
+		return err
+	}
+
+	if conflicts(atr.Response_Type, claims.Response_Type) || conflicts(atr.State, claims.State) || conflicts(atr.Address, claims.Address) ||
+		(len(atr.Resource) > 0 && !sameAudience(atr.Resource, claims.Resource)) ||
+		conflicts(normaliseScope(atr.Scope), normaliseScope(claims.Scope)) {
+		return errors.New("request parameters conflict with the request object")
+	}
+
+	atr.Response_Type = claims.Response_Type
+	atr.State = claims.State
+	atr.Address = claims.Address
+	atr.Resource = claims.Resource
+	atr.Scope = claims.Scope
+	atr.Request = ""
+	atr.Signed = true
+	atr.requestObjectJti = claims.Client_Id + ":" + claims.Jti
+	atr.requestObjectExpires = time.Unix(claims.Exp, 0)
+	return nil
+}
+
+// verifyRequestObject checks the request object signature against the client's registered keys
+// and validates the iss, aud, exp, jti and client_id claims
+// The jti is only checked for replays once the request is used, see consumeRequest
+func verifyRequestObject(request string, client *Client) (*RequestObjectClaims, error) {
+	if client.Jwks == nil {
+		return nil, errors.New("client has no registered keys")
+	}
+
+	jws, err := authorisation.ParseJWS(request)
+	if err != nil {
+		return nil, err
+	}
+	key := client.Jwks.FindKey(jws.Header.Kid)
+	if key == nil {
+		return nil, errors.New("request object key is not registered for this client")
+	}
+	err = jws.Verify(key)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &RequestObjectClaims{}
+	err = jws.Claims(claims)
+	if err != nil {
+		return nil, errors.New("request object claims are not valid JSON")
+	}
+
+	now := time.Now().Unix()
+	if claims.Iss != client.Client_Id || claims.Client_Id != client.Client_Id {
+		return nil, errors.New("request object was not issued by this client")
+	}
+	if !claims.Aud.contains(config.Issuer) {
+		return nil, errors.New("request object audience does not include this server")
+	}
+	if claims.Exp <= now || claims.Exp > now+int64(config.Request_Object.Max_Lifetime) {
+		return nil, errors.New("request object has expired or is valid for too long")
+	}
+	if claims.Nbf > now {
+		return nil, errors.New("request object is not valid yet")
+	}
+	if claims.Jti == "" {
+		return nil, errors.New("request object has no jti")
+	}
+
+	return claims, nil
+}
+
+// requestObjectFetcher fetches request_uris over https from public addresses only
+// Anyone can register a client, so a request_uri could otherwise make this service request internal addresses;
+// the address is checked as each connection is made, so neither DNS nor a redirect can point it elsewhere
+var requestObjectFetcher = &http.Client{
+	Timeout: 5 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: refusePrivateAddress}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("request_uri redirected too many times")
+		}
+		if req.URL.Scheme != "https" {
+			return errors.New("request_uri redirected away from https")
+		}
+		return nil
+	},
+}
+
+// refusePrivateAddress stops requestObjectFetcher connecting to anything but a public address
+func refusePrivateAddress(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return errors.New("request_uri resolves to an address that is not public: " + host)
+	}
+	return nil
+}
+
+// publicAddress reports whether ip may be reached from the internet, rather than being loopback, private,
+// link-local, shared or unspecified
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is not reachable from the internet
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// fetchRequestObject downloads a request object from a registered request_uri
+func fetchRequestObject(requestUri string) (string, error) {
+	if u, err := url.Parse(requestUri); err != nil || u.Scheme != "https" {
+		return "", errors.New("request_uri must use https")
+	}
+	resp, err := requestObjectFetcher.Get(requestUri)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("request_uri returned " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: requestObjectMaxSize})
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// ClientRequiresSignedRequest checks whether the client may only use signed request objects
+func clientRequiresSignedRequest(client_id string) bool {
+	client, err := store.findClient(client_id)
+	return err == nil && client.Require_Signed_Request
+}
+
+// conflicts reports whether a plain parameter was sent with a different value to the signed one
+func conflicts(plain string, signed string) bool {
+	return plain != "" && plain != signed
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
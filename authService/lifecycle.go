@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// workerGroup runs the background goroutines that live as long as the server
+type workerGroup struct {
+	mutex   sync.Mutex
+	workers []*worker
+}
+
+type worker struct {
+	name string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// workers holds every background worker so shutdown can stop them
+var workers = &workerGroup{}
+
+// start runs fn in the background until stop is called
+// fn must return promptly once its stop channel is closed
+func (group *workerGroup) start(name string, fn func(stop <-chan struct{})) {
+	w := &worker{name: name, stop: make(chan struct{}), done: make(chan struct{})}
+	group.mutex.Lock()
+	group.workers = append(group.workers, w)
+	group.mutex.Unlock()
+
+	go func() {
+		defer close(w.done)
+		fn(w.stop)
+	}()
+}
+
+// stop stops the workers one at a time, newest first, so no worker outlives one it was started after
+func (group *workerGroup) stop() {
+	group.mutex.Lock()
+	stopping := group.workers
+	group.workers = nil
+	group.mutex.Unlock()
+
+	for i := len(stopping) - 1; i >= 0; i-- {
+		close(stopping[i].stop)
+		<-stopping[i].done
+	}
+}
+
+// newServer creates an http.Server for handler with the configured timeouts
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              config.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: time.Duration(config.Server.Read_Timeout) * time.Second,
+		ReadTimeout:       time.Duration(config.Server.Read_Timeout) * time.Second,
+		WriteTimeout:      time.Duration(config.Server.Write_Timeout) * time.Second,
+		IdleTimeout:       time.Duration(config.Server.Idle_Timeout) * time.Second,
+	}
+}
+
+// serve runs server until a listener fails or the process receives SIGTERM or SIGINT,
+// then shuts everything down
+func serve(server *http.Server) error {
+	servers := []*http.Server{server}
+	errs := make(chan error, 2)
+	if config.TLS.Cert_File != "" {
+		redirect, err := setupTLS(server)
+		if err != nil {
+			workers.stop()
+			return err
+		}
+		if redirect != nil {
+			servers = append(servers, redirect)
+			go func() {
+				errs <- redirect.ListenAndServe()
+			}()
+		}
+		go func() {
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+	} else {
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-signals:
+		logger.Info("Shutting down", "signal", sig.String())
+		//Give load balancers time to see /readyz fail before the listener closes
+		atomic.StoreInt32(&shuttingDown, 1)
+		time.Sleep(time.Duration(config.Health.Shutdown_Delay) * time.Second)
+	}
+
+	shutdownErr := shutdown(servers, time.Duration(config.Server.Shutdown_Timeout)*time.Second)
+	if err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// shutdown stops accepting connections and waits up to timeout for in-flight requests,
+// then stops the background workers and closes the database pool
+// Requests still running at the deadline are cut off
+func shutdown(servers []*http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+	var errMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+				server.Close()
+				errMutex.Lock()
+				err = shutdownErr
+				errMutex.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	workers.stop()
+	store.close()
+	return err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/imryano/utils/random"
+)
+
+const requestIDHeader string = "X-Request-ID"
+const maxRequestIDLength int = 128
+
+// logger is the process logger; main replaces it once the configuration is loaded
+var logger = newLogger(os.Stderr, defaultConfig().Log)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// sensitiveLogKeys are attribute names whose values are never written to the log
+var sensitiveLogKeys = map[string]bool{
+	"access_token":              true,
+	"refresh_token":             true,
+	"client_secret":             true,
+	"registration_access_token": true,
+	"initial_access_token":      true,
+	"token":                     true,
+	"secret":                    true,
+	"password":                  true,
+	"authorization":             true,
+	"dpop":                      true,
+	"request":                   true,
+}
+
+type requestLogKey struct{}
+
+// requestLog collects the attributes handlers add to the request's access log line
+type requestLog struct {
+	requestID string
+	logger    *slog.Logger
+	mutex     sync.Mutex
+	attrs     []slog.Attr
+}
+
+func newLogger(w io.Writer, settings LogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logLevels[settings.Level], ReplaceAttr: redactAttr}
+	if settings.Format == "text" {
+		return slog.New(slog.NewTextHandler(w, options))
+	}
+	return slog.New(slog.NewJSONHandler(w, options))
+}
+
+// redactAttr replaces the value of any attribute named after a credential, at any depth
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveLogKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, "REDACTED")
+	}
+	return attr
+}
+
+// requestLogger returns the logger for the request, which adds its request ID to every record
+func requestLogger(r *http.Request) *slog.Logger {
+	if log, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		return log.logger
+	}
+	return logger
+}
+
+// logAttrs adds attributes such as client_id and outcome to the request's access log line
+func logAttrs(r *http.Request, attrs ...slog.Attr) {
+	if log, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		log.mutex.Lock()
+		log.attrs = append(log.attrs, attrs...)
+		log.mutex.Unlock()
+	}
+}
+
+// withRequestLog gives the request an ID, taken from X-Request-ID when the caller sent a usable one,
+// and returns the request carrying its logger and the collector for its access log line
+func withRequestLog(w http.ResponseWriter, r *http.Request) (*http.Request, *requestLog) {
+	requestID := r.Header.Get(requestIDHeader)
+	if !validRequestID(requestID) {
+		requestID, _ = random.GenerateRandomString(16)
+	}
+	w.Header().Set(requestIDHeader, requestID)
+
+	log := &requestLog{requestID: requestID, logger: logger.With(slog.String("request_id", requestID))}
+	return r.WithContext(context.WithValue(r.Context(), requestLogKey{}, log)), log
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces, so a caller cannot forge log lines
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// LogValue keeps token values out of the log when an AccessToken is logged
+func (at AccessToken) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("client_id", at.Client_Id),
+		slog.String("address", at.Address),
+		slog.String("token_type", at.Token_Type),
+		slog.String("scope", at.Scope),
+		slog.Any("aud", at.Aud),
+	)
+}
+
+// LogValue keeps the client secret and request object out of the log when an AccessTokenRequest is logged
+func (atr AccessTokenRequest) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("client_id", atr.Client_Id),
+		slog.String("address", atr.Address),
+		slog.String("response_type", atr.Response_Type),
+		slog.String("scope", atr.Scope),
+		slog.Any("resource", atr.Resource),
+	)
+}
+
+// LogValue keeps the secret and registration token hashes out of the log when a Client is logged
+func (client Client) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("client_id", client.Client_Id),
+		slog.String("client_name", client.Client_Name),
+		slog.String("address", client.Address),
+		slog.Bool("disabled", client.Disabled),
+	)
+}
@@ -2,23 +2,40 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/imryano/utils/random"
-	"gopkg.in/mgo.v2"
+	"github.com/imryano/OAuth/authPackage"
 	"gopkg.in/mgo.v2/bson"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
-const dbUrl string = "127.0.0.1"
-const dbName string = "authDB"
 const accessTokenCol string = "accessTokens"
 const clientCol string = "clients"
 
+var errUnknownClient = errors.New("unknown or disabled client")
+
 type AccessTokenRequest struct {
 	Response_Type string
 	Client_Id     string
 	State         string
 	Address       string
+	Request_Uri   string   `bson:",omitempty"`
+	Request       string   `bson:",omitempty"`
+	Signed        bool     `json:"-" bson:",omitempty"`
+	Resource      []string `bson:",omitempty"`
+	Scope         string   `bson:",omitempty"`
+	Jkt           string   `json:"-" bson:",omitempty"`
+	Client_Secret string   `bson:"-"`
+	//pushedRequestUri is the request_uri the parameters were read from, see resolveRequestUri
+	pushedRequestUri string
+	//requestObjectJti identifies the signed request object the parameters were read from, see resolveRequestObject
+	requestObjectJti     string
+	requestObjectExpires time.Time
 }
 
 func (atr AccessTokenRequest) String() string {
@@ -36,10 +53,22 @@ type AccessToken struct {
 	Id            bson.ObjectId `bson:"_id,omitempty"`
 	Client_Id     string        `bson:"client_id"`
 	Address       string        `bson:"address"`
-	Access_Token  string        `bson:"access_token"`
-	Refresh_Token string        `bson:"refresh_token"`
+	Access_Token  string        `bson:"-" json:",omitempty"`
+	Refresh_Token string        `bson:"-" json:",omitempty"`
 	Token_Type    string        `bson:"token_type"`
 	Expires       int           `bson:"expires"`
+	Jkt           string        `bson:"jkt,omitempty" json:"-"`
+	Aud           []string      `bson:"aud,omitempty"`
+	Scope         string        `bson:"scope,omitempty"`
+	Created       time.Time     `bson:"created,omitempty"`
+	Expires_At    time.Time     `bson:"expires_at,omitempty" json:"-"`
+	//Allowed_Addresses is the issuing client's address binding, see Client.addressBinding
+	Allowed_Addresses []string `bson:"allowed_addresses,omitempty"`
+	//Token values are only stored as hashes, see GetBSON
+	Access_Token_Hash  string `bson:"access_token_hash,omitempty" json:",omitempty"`
+	Refresh_Token_Hash string `bson:"refresh_token_hash,omitempty" json:",omitempty"`
+	//allowed is the address binding parsed for matching, see allowedAddresses
+	allowed *addressSet
 }
 
 func (at AccessToken) String() string {
@@ -51,168 +80,428 @@ func (at AccessToken) String() string {
 		refresh_token: 	%s
 		token_type:    	%s
 		expires:		%d
+		jkt:			%s
+		aud:			%v
 	`
 
-	return fmt.Sprintf(format, at.Id, at.Client_Id, at.Address, at.Access_Token, at.Refresh_Token, at.Token_Type, at.Expires)
+	return fmt.Sprintf(format, at.Id, at.Client_Id, at.Address, at.Access_Token, at.Refresh_Token, at.Token_Type, at.Expires, at.Jkt, at.Aud)
 }
 
 type Client struct {
-	Id        bson.ObjectId `bson:"_id,omitempty"`
-	Client_Id string        `bson:"client_id"`
-	Address   string        `bson:"address"`
+	Id                      bson.ObjectId `bson:"_id,omitempty"`
+	Client_Id               string        `bson:"client_id"`
+	Address                 string        `bson:"address"`
+	Require_Par             bool          `bson:"require_par,omitempty"`
+	Require_Signed_Request  bool          `bson:"require_signed_request,omitempty"`
+	Allowed_Resources       []string      `bson:"allowed_resources,omitempty"`
+	Allowed_Addresses       []string      `bson:"allowed_addresses,omitempty"`
+	Binding_Key             string        `bson:"binding_key,omitempty"`
+	Client_Secret_Hash      string        `bson:"client_secret_hash,omitempty"`
+	Registration_Token_Hash string        `bson:"registration_token_hash,omitempty"`
+	Disabled                bool          `bson:"disabled,omitempty"`
+	Created                 time.Time     `bson:"created,omitempty"`
+	ClientMetadata          `bson:",inline"`
+	//allowed is the address binding parsed for matching, see allowedAddresses
+	allowed *addressSet
 }
 
 // GenerateClientID creates a client ID for  new service
 // Generate a client ID if one doesn't exist, or return the cleint ID if one does.
+// Concurrent first requests from one address all get the same client ID
 // Returns blank string if there is a failure
 func getClientID(w http.ResponseWriter, r *http.Request) {
-	client := &Client{}
-	result := &Client{}
+	client := &Client{Address: clientAddress(r)}
 
-	session, err := mgo.Dial(dbUrl)
+	defer observeStorage("get_client_id", time.Now())
+	client, created, err := store.bindClient(client.Address)
 	if err == nil {
-		col := session.DB(dbName).C(clientCol)
-
-		client.Address = r.RemoteAddr
-
-		err = col.Find(bson.M{"address": client.Address}).One(result)
-		if err != nil {
-			client.Client_Id, err = random.GenerateRandomString(50)
-			if err == nil {
-				err = col.Insert(client)
-				if err == nil {
-					fmt.Fprintln(w, client.Client_Id)
-				}
-			}
-		} else {
-			client.Client_Id = result.Client_Id
-			fmt.Fprintln(w, client.Client_Id)
+		if created {
+			audit(r, auditClientRegistered, client.Client_Id, client.Client_Id, map[string]string{"endpoint": "getclientid"})
 		}
+		fmt.Fprintln(w, client.Client_Id)
 	}
+	if err != nil {
+		requestLogger(r).Error("Could not get client ID", "address", clientAddress(r), "error", err)
+		client = &Client{}
+	}
+	logAttrs(r, slog.String("client_id", client.Client_Id))
 	fmt.Fprintln(w, "")
 }
 
 // GenerateAccessToken creates a key for a validated client
 // Generate and return either an AccessToken or an error
+// If the request carries a DPoP proof the token is bound to the proof's key
+// If the request carries a request_uri or signed request object, its parameters are used instead
 func getAccessToken(w http.ResponseWriter, r *http.Request) {
 	atr := &AccessTokenRequest{}
 
 	err := json.NewDecoder(r.Body).Decode(&atr)
 	if err == nil {
-		accessToken := atr.getAccessToken()
-		if accessToken != nil {
-			if accessToken.validate() {
-				err = json.NewEncoder(w).Encode(accessToken)
+		logAttrs(r, slog.String("client_id", atr.Client_Id), slog.String("grant_type", "client_credentials"))
+		if !allowAuthentication(w, r, atr.Client_Id) {
+			logAttrs(r, slog.String("outcome", "rate_limited"))
+			return
+		}
+		err = atr.authenticateClient(r)
+		if err != nil {
+			authFailed(r, atr.Client_Id)
+			audit(r, auditAuthFailed, atr.Client_Id, atr.Client_Id, map[string]string{"endpoint": "getaccesstoken", "reason": err.Error()})
+			logAttrs(r, slog.String("outcome", "invalid_client"), slog.String("error", err.Error()))
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", err.Error())
+			return
+		}
+
+		err = atr.resolveRequestUri()
+		if err == nil {
+			err = atr.resolveRequestObject()
+		}
+		if err == nil {
+			err = atr.resolveAddress(r)
+		}
+		if err != nil {
+			logAttrs(r, slog.String("outcome", "invalid_request"), slog.String("error", err.Error()))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		//Clients without a secret authenticate by their address, so the client's rate limit is only charged
+		//once both are checked; a caller naming someone else's client_id cannot use it up
+		if !checkClientExists(atr.Address, atr.Client_Id) {
+			authFailed(r, atr.Client_Id)
+			audit(r, auditAuthFailed, atr.Client_Id, atr.Client_Id, map[string]string{"endpoint": "getaccesstoken", "reason": errUnknownClient.Error()})
+			logAttrs(r, slog.String("outcome", "invalid_client"))
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", errUnknownClient.Error())
+			return
+		}
+		if !allowClient(w, r, atr.Client_Id) {
+			logAttrs(r, slog.String("outcome", "rate_limited"))
+			return
+		}
+
+		err = atr.checkResources()
+		if err != nil {
+			logAttrs(r, slog.String("outcome", "invalid_target"), slog.String("error", err.Error()))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_target", err.Error())
+			return
+		}
+
+		err = atr.checkScope()
+		if err != nil {
+			logAttrs(r, slog.String("outcome", "invalid_scope"), slog.String("error", err.Error()))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_scope", err.Error())
+			return
+		}
+
+		if r.Header.Get("DPoP") != "" {
+			proof, err := verifyDPoPRequest(r, "", config.DPoP.Require_Nonce)
+			if err != nil {
+				logAttrs(r, slog.String("outcome", "invalid_dpop_proof"), slog.String("error", err.Error()))
+				writeDPoPError(w, err)
+				return
+			}
+			atr.Jkt = proof.Jkt
+			if nonce := issueDPoPNonce(); nonce != "" {
+				w.Header().Set("DPoP-Nonce", nonce)
 			}
 		}
+
+		err = atr.consumeRequest()
+		if err != nil {
+			logAttrs(r, slog.String("outcome", "invalid_request"), slog.String("error", err.Error()))
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		accessToken, err := atr.getAccessToken()
+		if err == errUnknownClient {
+			authFailed(r, atr.Client_Id)
+			audit(r, auditAuthFailed, atr.Client_Id, atr.Client_Id, map[string]string{"endpoint": "getaccesstoken", "reason": err.Error()})
+			logAttrs(r, slog.String("outcome", "invalid_client"))
+			return
+		} else if err != nil {
+			requestLogger(r).Error("Could not issue access token", "client_id", atr.Client_Id, "error", err)
+			logAttrs(r, slog.String("outcome", "failed"))
+			return
+		}
+		resource := ""
+		if len(accessToken.Aud) > 0 {
+			resource = accessToken.Aud[0]
+		}
+		if accessToken.validate(resource) {
+			logAttrs(r, slog.String("outcome", "issued"))
+			authSucceeded(r, atr.Client_Id)
+			audit(r, auditTokenIssued, atr.Client_Id, atr.Client_Id, map[string]string{
+				"token_id":   accessToken.Id.Hex(),
+				"token_type": accessToken.Token_Type,
+				"scope":      accessToken.Scope,
+				"aud":        strings.Join(accessToken.Aud, " "),
+			})
+			err = json.NewEncoder(w).Encode(accessToken)
+		}
 	} else {
-		fmt.Println(err.Error())
+		logAttrs(r, slog.String("outcome", "malformed"), slog.String("error", err.Error()))
 	}
 }
 
-// Generates and returns an AccessToken string
-// Will return nil if there is any kind of error
-func (atr *AccessTokenRequest) getAccessToken() *AccessToken {
-	session, err := mgo.Dial(dbUrl)
-	if err == nil {
-		db := session.DB(dbName)
-		cClient := db.C(clientCol)
-		//Check Database for existing access token
-		if checkClientExists(cClient, atr.Address, atr.Client_Id) {
-			cAccessToken := db.C(accessTokenCol)
-			exists, accessToken := getExistingAccessToken(cAccessToken, atr.Address, atr.Client_Id)
-			if !exists {
-				accessToken = atr.createAccessToken(cAccessToken)
-			}
-			return accessToken
-		}
+// Generates and returns a new AccessToken
+// Existing tokens cannot be handed out again as only their hashes are stored
+// Returns an error if the client is unknown or the token could not be stored
+func (atr *AccessTokenRequest) getAccessToken() (*AccessToken, error) {
+	defer observeStorage("issue_token", time.Now())
+	if !checkClientExists(atr.Address, atr.Client_Id) {
+		return nil, errUnknownClient
 	}
+	refreshing := holdsUnexpiredToken(atr.Client_Id)
+	accessToken := atr.createAccessToken()
+	if accessToken == nil {
+		return nil, errors.New("could not store access token")
+	}
+	tokensIssued.WithLabelValues(clientLabel(atr.Client_Id), accessToken.Token_Type, "getaccesstoken").Inc()
+	if refreshing {
+		tokensRefreshed.WithLabelValues(clientLabel(atr.Client_Id)).Inc()
+	}
+	return accessToken, nil
+}
 
-	return nil
+//HoldsUnexpiredToken reports whether the client's newest token has not yet expired
+//A client asking for a token while it holds one is refreshing it, which the metrics count separately
+func holdsUnexpiredToken(client_id string) bool {
+	tokens, err := store.listTokens(tokenFilter{Client_Id: client_id}, 1)
+	return err == nil && len(tokens) > 0 && time.Now().Before(tokens[0].expiresAt())
 }
 
 // CreateAccessToken creates an AccessToken object from an AccessToken request
 // Does not handle Client validation
-func (atr *AccessTokenRequest) createAccessToken(c *mgo.Collection) *AccessToken {
-	accessToken := &AccessToken{}
+func (atr *AccessTokenRequest) createAccessToken() *AccessToken {
+	accessToken := &AccessToken{Id: bson.NewObjectId()}
 	var err error
 
 	accessToken.Client_Id = atr.Client_Id
-	accessToken.Access_Token, err = random.GenerateRandomString(50)
+	accessToken.Access_Token, err = authorisation.GenerateToken(authorisation.AccessTokenType, config.Tokens.Length)
 
 	if err == nil {
-		accessToken.Refresh_Token, err = random.GenerateRandomString(50)
-		accessToken.Expires = 600
+		accessToken.Refresh_Token, err = authorisation.GenerateToken(authorisation.RefreshTokenType, config.Tokens.Length)
+		accessToken.Expires = config.Tokens.Expires
 		accessToken.Token_Type = "token"
 		accessToken.Address = atr.Address
+		accessToken.Aud = atr.Resource
+		accessToken.Scope = atr.Scope
+		accessToken.Created = time.Now()
+		accessToken.Expires_At = accessToken.Created.Add(time.Duration(accessToken.Expires) * time.Second)
+		if client, err := store.findClient(atr.Client_Id); err == nil {
+			accessToken.Allowed_Addresses = client.addressBinding()
+		}
+		if atr.Jkt != "" {
+			accessToken.Token_Type = "DPoP"
+			accessToken.Jkt = atr.Jkt
+		}
 
-		//Write to database
-		err = c.Insert(accessToken)
+		//Write to database, revoking the client's oldest tokens beyond tokens.max_per_client
+		//Every request for a token issues a new one, so this stops a client that asks on every call filling the database
+		var removed int
+		removed, err = store.insertToken(accessToken, config.Tokens.Max_Per_Client)
 		if err == nil {
+			if removed > 0 {
+				tokensRevoked.WithLabelValues(clientLabel(atr.Client_Id), "token_limit").Add(float64(removed))
+			}
 			return accessToken
 		}
 	}
+	logger.Error("Could not create access token", "client_id", atr.Client_Id, "error", err)
 	return nil
 }
 
-//CheckClientExists checks if the client exists by address and client id
-//Returns true if it does, false if it doesn't
-func checkClientExists(c *mgo.Collection, address string, client_id string) bool {
-	numResults, err := c.Find(bson.M{"client_id": client_id, "address": address}).Count()
-	return (numResults > 0 && err == nil)
-}
-
-//GetExistingAccessToken grabs any existing access tokens based on address and client id
-//Returns true and the access token if it exists, false if it doesn't
-func getExistingAccessToken(c *mgo.Collection, address string, client_id string) (bool, *AccessToken) {
-	at := &AccessToken{}
-	numResults, err := c.Find(bson.M{"client_id": client_id, "address": address}).Count()
-	if numResults > 0 && err == nil {
-		err = c.Find(bson.M{"client_id": client_id, "address": address}).One(at)
-		return (err == nil), at
-	} else {
-		return false, nil
+//ResolveAddress binds the request to the address it came from
+//An address sent by the client is only a claim, so it is rejected unless it is the address the request came from
+func (atr *AccessTokenRequest) resolveAddress(r *http.Request) error {
+	address := clientAddress(r)
+	if atr.Address != "" && normalizeAddress(atr.Address) != address {
+		return errors.New("address does not match the address the request came from")
 	}
+	atr.Address = address
+	return nil
+}
+
+//CheckClientExists checks if an enabled client exists with the client id and allows the address
+//Returns true if it does, false if it doesn't
+func checkClientExists(address string, client_id string) bool {
+	client, err := store.findClient(client_id)
+	return err == nil && !client.Disabled && client.allowedAddresses().matches(address)
 }
 
 // Validates the access token object and handles all validation
-func (accessToken *AccessToken) validate() bool {
-	session, err := mgo.Dial(dbUrl)
-	if err == nil {
-		c := session.DB(dbName).C(accessTokenCol)
-		return validateAccessToken(c, *accessToken)
+// resource is the resource server the token is being presented to
+func (accessToken *AccessToken) validate(resource string) bool {
+	return accessToken.validationOutcome(resource) == "valid"
+}
+
+// ValidationOutcome validates the access token and returns valid, malformed, rejected or storage_error
+// Malformed tokens are rejected before the database is asked
+func (accessToken *AccessToken) validationOutcome(resource string) string {
+	if !accessTokenFormatAccepted(accessToken.Access_Token) {
+		return "malformed"
 	}
-	return false
+	defer observeStorage("validate_token", time.Now())
+	stored, err := store.findToken(accessToken.Access_Token)
+	if err == errNotFound || (err == nil && !stored.accepts(accessToken, resource)) {
+		return "rejected"
+	} else if err != nil {
+		return "storage_error"
+	}
+	return "valid"
 }
 
 // Authorise returns true if the key matches the client id, address and access_code
+// A DPoP-bound token must be presented with a DPoP proof, which this service verifies itself: either a proof for this
+// request, or the proof a resource server received with the method and URL it was sent to, see verifyDPoPAuthorise
+// The resource query parameter names the resource server, and must be in an audience-restricted token's aud
 // Returns false if any validation fails
 func authorise(w http.ResponseWriter, r *http.Request) {
 	var accessToken AccessToken
 	if r.Body == nil {
+		logAttrs(r, slog.String("outcome", "malformed"))
+		tokenValidations.WithLabelValues("malformed").Inc()
 		http.Error(w, "Please send a request body", 400)
 		return
 	}
 
 	err := json.NewDecoder(r.Body).Decode(&accessToken)
 	if err != nil {
+		logAttrs(r, slog.String("outcome", "malformed"))
+		tokenValidations.WithLabelValues("malformed").Inc()
 		http.Error(w, err.Error(), 400)
 		return
 	}
 
-	fmt.Fprintln(w, accessToken.validate())
+	if !allowValidation(w, r) {
+		logAttrs(r, slog.String("client_id", accessToken.Client_Id), slog.String("outcome", "rate_limited"))
+		return
+	}
+
+	accessToken.Address = normalizeAddress(accessToken.Address)
+	//Anyone can send a thumbprint, so the key is only taken from a proof verified here
+	accessToken.Jkt = ""
+	if r.Header.Get("DPoP") != "" {
+		proof, err := verifyDPoPAuthorise(r, accessToken.Access_Token)
+		if err != nil {
+			logAttrs(r, slog.String("client_id", accessToken.Client_Id), slog.String("outcome", "invalid_dpop"))
+			tokenValidations.WithLabelValues("invalid_dpop").Inc()
+			writeDPoPError(w, err)
+			return
+		}
+		accessToken.Jkt = proof.Jkt
+	}
+
+	outcome := accessToken.validationOutcome(r.URL.Query().Get("resource"))
+	logAttrs(r, slog.String("client_id", accessToken.Client_Id), slog.String("outcome", outcome))
+	tokenValidations.WithLabelValues(outcome).Inc()
+	switch outcome {
+	case "valid":
+		validationSucceeded(r)
+	case "malformed", "rejected":
+		validationFailed(r)
+	}
+	fmt.Fprintln(w, outcome == "valid")
+}
+
+//Accepts checks the stored token was issued to the presented token's client
+//The token's address must be allowed by the binding copied from its client when it was issued
+//DPoP-bound tokens only match when the Jkt matches the bound key
+//Audience-restricted tokens only match when resource is in their aud
+func (stored *AccessToken) accepts(presented *AccessToken, resource string) bool {
+	return stored.Client_Id == presented.Client_Id &&
+		stored.Jkt == presented.Jkt &&
+		audienceAllows(stored.Aud, resource) &&
+		stored.allowedAddresses().matches(presented.Address)
 }
 
-//ValidateAccessToken checks the database for the AccessToken object
-func validateAccessToken(c *mgo.Collection, accessToken AccessToken) bool {
-	numResults, err := c.Find(bson.M{"access_token": accessToken.Access_Token, "client_id": accessToken.Client_Id, "address": accessToken.Address}).Count()
-	return (numResults > 0 && err == nil)
+// writeOAuthError writes an OAuth 2.0 style JSON error response
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
 }
 
 // Create WebServer
 func main() {
-	http.HandleFunc("/getclientid", getClientID)
-	http.HandleFunc("/getaccesstoken", getAccessToken)
-	http.HandleFunc("/authorise", authorise)
-	http.ListenAndServe(":8080", nil)
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		os.Exit(runVerifyAudit(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	cfg, options, err := loadConfig(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if options.printConfig {
+		if err = cfg.print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	config = cfg
+	logger = newLogger(os.Stderr, config.Log)
+	slog.SetDefault(logger)
+	if config.Tokens.Pepper == "" {
+		if !config.Tokens.Allow_No_Pepper {
+			logger.Error("tokens.pepper must be set, or tokens.allow_no_pepper to store unkeyed token hashes")
+			os.Exit(2)
+		}
+		logger.Warn("tokens.pepper is not set, stored token hashes are unkeyed")
+	}
+	store, err = newStorage(config.Database)
+	if err != nil {
+		logger.Error("Could not open the database", "backend", config.Database.Backend, "error", err)
+		os.Exit(1)
+	}
+	if options.migrateOnly {
+		err = prepareDatabase(os.Stdout, options.dryRun)
+		store.close()
+		if err != nil {
+			logger.Error("Migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err = prepareDatabase(nil, false); err == errMigrationsLocked {
+		logger.Info("Waiting for another instance to finish migrations")
+		retryPrepareDatabase()
+	} else if err != nil {
+		logger.Error("Could not prepare the database", "error", err)
+		retryPrepareDatabase()
+	} else {
+		startExpirySweep()
+	}
+	addReadinessCheck("migrations", checkMigrations)
+	trustedProxies, _ = parseTrustedProxies(config.Server.Trusted_Proxies)
+	limiter = newLimiter(config.Rate_Limit)
+
+	logger.Info("Starting authService", "listen", config.Listen, "tls", config.TLS.Cert_File != "")
+	err = serve(newServer(routes()))
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("authService stopped", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("authService stopped")
+}
+
+//Routes returns the handler for every endpoint
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/getclientid", instrument("getclientid", getClientID))
+	mux.HandleFunc("/getaccesstoken", instrument("getaccesstoken", rateLimited(getAccessToken)))
+	mux.HandleFunc("/authorise", instrument("authorise", authoriseLimited(authorise)))
+	mux.HandleFunc("/par", instrument("par", rateLimited(pushAuthorisationRequest)))
+	mux.HandleFunc(registrationPath, instrument("register", rateLimited(registerClient)))
+	mux.HandleFunc(registrationPath+"/", instrument("manage_registration", rateLimited(manageRegistration)))
+	mux.HandleFunc(adminPath, instrument("admin", rateLimited(adminHandler)))
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	if config.Metrics.Enabled {
+		mux.HandleFunc("/metrics", metricsHandler)
+	}
+	return mux
 }
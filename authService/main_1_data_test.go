@@ -82,7 +82,7 @@ func InsertAccessTokens() bool {
 }
 
 func GetTestCollection(colName string) (bool, *mgo.Collection) {
-	session, err := mgo.Dial(dbUrl)
+	session, err := mgo.Dial(config.Database.Url)
 	if err == nil {
 		c := session.DB(dbTest).C(colName)
 		return true, c
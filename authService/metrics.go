@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// otherClient replaces client_id labels once metrics.max_client_labels clients have been seen
+const otherClient string = "other"
+
+var (
+	tokensIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_tokens_issued_total", Help: "Access tokens issued, by client, token type and the endpoint that issued them",
+	}, []string{"client_id", "token_type", "endpoint"})
+	tokensRefreshed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_tokens_refreshed_total", Help: "Access tokens issued to a client that still held an unexpired token",
+	}, []string{"client_id"})
+	tokensRevoked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_tokens_revoked_total", Help: "Access tokens revoked",
+	}, []string{"client_id", "reason"})
+	tokenValidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_token_validations_total", Help: "Token validations at /authorise",
+	}, []string{"outcome"})
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_rate_limited_total", Help: "Requests refused by a rate limit or lockout",
+	}, []string{"limit"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "auth_http_request_duration_seconds", Help: "Time taken to handle HTTP requests",
+	}, []string{"handler", "code"})
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "auth_storage_duration_seconds", Help: "Time taken by database operations",
+	}, []string{"operation"})
+)
+
+var activeTokensDesc = prometheus.NewDesc("auth_access_tokens", "Access tokens currently stored", []string{"token_type"}, nil)
+
+// registry holds every metric served at /metrics, with the Go runtime and process metrics
+var registry = prometheus.NewRegistry()
+
+var metricsExposer = promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError})
+
+func init() {
+	registry.MustRegister(tokensIssued, tokensRefreshed, tokensRevoked, tokenValidations, rateLimitedRequests,
+		requestDuration, storageDuration, activeTokenCollector{},
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// metricClients is the set of client_ids given their own label value
+var metricClients = map[string]bool{}
+var metricClientsMutex sync.Mutex
+
+// clientLabel returns client_id as a label value until metrics.max_client_labels clients have been seen,
+// and "other" for any client after that, so unbounded registrations cannot grow the series without limit
+func clientLabel(client_id string) string {
+	metricClientsMutex.Lock()
+	defer metricClientsMutex.Unlock()
+	if metricClients[client_id] {
+		return client_id
+	}
+	if len(metricClients) >= config.Metrics.Max_Client_Labels {
+		return otherClient
+	}
+	metricClients[client_id] = true
+	return client_id
+}
+
+// observeStorage records the time a database operation has taken since begin
+func observeStorage(operation string, begin time.Time) {
+	storageDuration.WithLabelValues(operation).Observe(time.Since(begin).Seconds())
+}
+
+// activeTokenCollector counts the stored access tokens by token type when /metrics is scraped
+type activeTokenCollector struct{}
+
+func (activeTokenCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeTokensDesc
+}
+
+// Collect counts the tokens within health.check_timeout; a failed count leaves the gauge out of the scrape
+// The count runs on the scrape's goroutine with the deadline in its context, so none is left behind on timeout
+func (activeTokenCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Health.Check_Timeout)*time.Second)
+	defer cancel()
+	begin := time.Now()
+	counts, err := store.countTokens(ctx)
+	observeStorage("count_tokens", begin)
+	if err != nil {
+		logger.Warn("Could not count access tokens for metrics", "error", err)
+		return
+	}
+	for token_type, count := range counts {
+		ch <- prometheus.MustNewConstMetric(activeTokensDesc, prometheus.GaugeValue, float64(count), token_type)
+	}
+}
+
+// metricsHandler serves every metric in the Prometheus exposition format
+// When metrics.token is set the scraper must send it as a bearer token, as labels include client IDs
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Metrics.Token != "" && !secretsEqual(bearerToken(r), config.Metrics.Token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	metricsExposer.ServeHTTP(w, r)
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection, so handlers can change its deadlines
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// instrument records the duration and status code of every request to handler under name,
+// and writes an access log line with the request ID and any attributes the handler added
+// name is the route, never the request path, to keep the handler label bounded
+func instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		begin := time.Now()
+		r, log := withRequestLog(w, r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		requestDuration.WithLabelValues(name, strconv.Itoa(recorder.status)).Observe(time.Since(begin).Seconds())
+
+		level := slog.LevelInfo
+		if recorder.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		log.mutex.Lock()
+		attrs := append([]slog.Attr{
+			slog.String("handler", name),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("latency_ms", float64(time.Since(begin).Microseconds())/1000),
+		}, log.attrs...)
+		log.mutex.Unlock()
+		log.logger.LogAttrs(r.Context(), level, "request", attrs...)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const migrationCol string = "migrations"
+const migrationLockCol string = "migrationLock"
+
+// migrationLockLifetime is how long a lock is held without being renewed before another instance may take it,
+// in case the instance holding it stopped part way through
+const migrationLockLifetime time.Duration = 10 * time.Minute
+
+// migrationRetryInterval is how often an instance that found another migrating tries the migrations again
+var migrationRetryInterval time.Duration = 30 * time.Second
+
+var errMigrationsLocked = errors.New("another instance is running migrations")
+
+// migration is one change to data stored in MongoDB by earlier versions
+// Versions are permanent: add new migrations to the end of migrations and never renumber or remove one
+// Apply must be safe to run again after a partial failure, and in a dry run only count what it would change
+type migration struct {
+	version int
+	name    string
+	apply   func(db *mgo.Database, dryRun bool) (int, error)
+}
+
+// migrations are applied in order, each once per database
+var migrations = []migration{
+	{1, "normalize_addresses", func(db *mgo.Database, dryRun bool) (int, error) {
+		clients, err := normalizeStoredAddresses(db.C(clientCol), dryRun)
+		if err != nil {
+			return clients, err
+		}
+		tokens, err := normalizeStoredAddresses(db.C(accessTokenCol), dryRun)
+		return clients + tokens, err
+	}},
+	{2, "hash_stored_tokens", func(db *mgo.Database, dryRun bool) (int, error) {
+		return hashStoredTokens(db.C(accessTokenCol), dryRun)
+	}},
+	{3, "set_token_expiry", func(db *mgo.Database, dryRun bool) (int, error) {
+		return setTokenExpiry(db.C(accessTokenCol), dryRun)
+	}},
+	{4, "set_client_binding_keys", func(db *mgo.Database, dryRun bool) (int, error) {
+		return setClientBindingKeys(db.C(clientCol), dryRun)
+	}},
+}
+
+// appliedMigration records a migration in the migrations collection
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	Applied   time.Time `bson:"applied"`
+	Documents int       `bson:"documents"`
+}
+
+// migrationLock stops two instances starting at once from running the same migration
+type migrationLock struct {
+	Id      string    `bson:"_id"`
+	Owner   string    `bson:"owner"`
+	Expires time.Time `bson:"expires"`
+}
+
+// migrationResult reports what runMigrations did with one migration: applied, already applied or pending
+type migrationResult struct {
+	Version   int
+	Name      string
+	Action    string
+	Documents int
+}
+
+// appliedMigrations returns the recorded migrations by version
+func appliedMigrations(db *mgo.Database) (map[int]appliedMigration, error) {
+	records := []appliedMigration{}
+	if err := db.C(migrationCol).Find(nil).All(&records); err != nil {
+		return nil, err
+	}
+	applied := map[int]appliedMigration{}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// pendingMigrations returns the migrations not yet recorded as applied
+func pendingMigrations(db *mgo.Database) ([]migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	pending := []migration{}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// lockMigrations takes the migration lock for owner, or returns errMigrationsLocked if another owner holds it
+// Taking the lock again before it expires renews it
+func lockMigrations(db *mgo.Database, owner string) error {
+	c := db.C(migrationLockCol)
+	lock := migrationLock{Id: migrationCol, Owner: owner, Expires: time.Now().Add(migrationLockLifetime)}
+	err := c.Insert(lock)
+	if mgo.IsDup(err) {
+		err = c.Update(bson.M{"_id": lock.Id, "$or": []bson.M{{"owner": owner}, {"expires": bson.M{"$lte": time.Now()}}}}, lock)
+		if err == mgo.ErrNotFound {
+			return errMigrationsLocked
+		}
+	}
+	return err
+}
+
+// unlockMigrations releases the migration lock if owner still holds it
+func unlockMigrations(db *mgo.Database, owner string) error {
+	err := db.C(migrationLockCol).Remove(bson.M{"_id": migrationCol, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// runMigrations applies each pending migration in order and records it, stopping at the first failure
+// A dry run takes no lock and changes nothing, reporting how many documents each pending migration would change
+func runMigrations(db *mgo.Database, dryRun bool) ([]migrationResult, error) {
+	results := []migrationResult{}
+	owner := migrationOwner()
+	if !dryRun {
+		if err := lockMigrations(db, owner); err != nil {
+			return results, err
+		}
+		stop := make(chan struct{})
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			renewMigrationLock(db, owner, stop)
+		}()
+		defer func() {
+			close(stop)
+			<-renewed
+			unlockMigrations(db, owner)
+		}()
+	}
+
+	//Read what has been applied once the lock is held, in case another instance finished first
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return results, err
+	}
+	for _, m := range migrations {
+		result := migrationResult{Version: m.version, Name: m.name}
+		if record, ok := applied[m.version]; ok {
+			result.Action = "already applied"
+			result.Documents = record.Documents
+			results = append(results, result)
+			continue
+		}
+
+		result.Documents, err = m.apply(db, dryRun)
+		if err != nil {
+			return results, fmt.Errorf("migration %d %s: %s", m.version, m.name, err)
+		}
+		if dryRun {
+			result.Action = "pending"
+			results = append(results, result)
+			continue
+		}
+		err = db.C(migrationCol).Insert(appliedMigration{Version: m.version, Name: m.name, Applied: time.Now(), Documents: result.Documents})
+		if err != nil {
+			return results, fmt.Errorf("migration %d %s: %s", m.version, m.name, err)
+		}
+		result.Action = "applied"
+		results = append(results, result)
+		if err = lockMigrations(db, owner); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// renewMigrationLock renews owner's lock every third of its lifetime until stop is closed, so a migration that takes
+// longer than the lifetime is not taken over part way through
+func renewMigrationLock(db *mgo.Database, owner string, stop <-chan struct{}) {
+	ticker := time.NewTicker(migrationLockLifetime / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := lockMigrations(db, owner); err != nil {
+				logger.Warn("Could not renew the migration lock", "error", err)
+			}
+		}
+	}
+}
+
+// migrationOwner names this process in the migration lock
+func migrationOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// reportMigrations writes each migration's result to report when it is not nil, and logs those applied
+func reportMigrations(report io.Writer, collection string, results []migrationResult) {
+	for _, result := range results {
+		if report != nil {
+			fmt.Fprintf(report, "%s\t%d %s\t%s, %d documents\n", collection, result.Version, result.Name, result.Action, result.Documents)
+		}
+		if result.Action == "applied" {
+			logger.Info("Migration applied", "version", result.Version, "name", result.Name, "documents", result.Documents)
+		}
+	}
+}
+
+// prepareDatabase brings the storage's schema and data up to date
+// The server runs this on every start, and again in the background until it succeeds
+func prepareDatabase(report io.Writer, dryRun bool) error {
+	return store.prepare(report, dryRun)
+}
+
+// retryPrepareDatabase prepares the database every migrationRetryInterval until it succeeds, so an instance that
+// started while another was migrating, or while the database was unavailable, becomes ready without a restart
+func retryPrepareDatabase() {
+	workers.start("migration retry", func(stop <-chan struct{}) {
+		ticker := time.NewTicker(migrationRetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := prepareDatabase(nil, false)
+				if err == nil {
+					logger.Info("Database prepared")
+					startExpirySweep()
+					return
+				} else if err != errMigrationsLocked {
+					logger.Error("Could not prepare the database", "error", err)
+				}
+			}
+		}
+	})
+}
+
+// checkMigrations reports whether every migration has been applied, so an instance that started while
+// another was migrating is not sent traffic until it has finished
+func checkMigrations(ctx context.Context) error {
+	pending, err := store.pendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d migrations pending, from %s", len(pending), pending[0])
+	}
+	return nil
+}
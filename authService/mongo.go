@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/imryano/utils/random"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoStorage keeps everything in the MongoDB database.name at database.url
+// Each call takes a session from the shared pool; expired documents are removed by TTL indexes
+type mongoStorage struct{}
+
+// session returns a pooled session and the configured database, honouring the context's deadline
+func (m *mongoStorage) session(ctx context.Context) (*mgo.Session, *mgo.Database, error) {
+	session, err := openDatabase()
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		session.SetSyncTimeout(time.Until(deadline))
+		session.SetSocketTimeout(time.Until(deadline))
+	}
+	return session, session.DB(config.Database.Name), nil
+}
+
+// mongoError translates the driver's errors into errNotFound and errDuplicate
+func mongoError(err error) error {
+	if err == mgo.ErrNotFound {
+		return errNotFound
+	} else if mgo.IsDup(err) {
+		return errDuplicate
+	}
+	return err
+}
+
+// bindClient upserts on the unique binding_key index, so of several concurrent requests one creates the
+// client and the others find it after their upsert fails as a duplicate
+// Clients created before binding keys are bound by the set_client_binding_keys migration
+func (m *mongoStorage) bindClient(address string) (*Client, bool, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	defer session.Close()
+	c := db.C(clientCol)
+
+	key := "address:" + address
+	for attempt := 0; attempt < 3; attempt++ {
+		client := &Client{}
+		err := c.Find(bson.M{"binding_key": key}).One(client)
+		if err != mgo.ErrNotFound {
+			return client, false, err
+		}
+
+		client_id, err := random.GenerateRandomString(config.Tokens.Length)
+		if err != nil {
+			return nil, false, err
+		}
+		change := mgo.Change{
+			Update:    bson.M{"$setOnInsert": bson.M{"client_id": client_id, "address": address, "created": time.Now()}},
+			Upsert:    true,
+			ReturnNew: true,
+		}
+		info, err := c.Find(bson.M{"binding_key": key}).Apply(change, client)
+		if mgo.IsDup(err) {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		return client, info.UpsertedId != nil, nil
+	}
+	return nil, false, errors.New("could not create a client for " + address)
+}
+
+func (m *mongoStorage) findClient(client_id string) (*Client, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	client := &Client{}
+	err = db.C(clientCol).Find(bson.M{"client_id": client_id}).One(client)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return client, nil
+}
+
+func (m *mongoStorage) listClients(filter clientFilter) ([]Client, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	query := bson.M{}
+	if filter.Prefix != "" {
+		prefix := bson.RegEx{Pattern: "^" + regexp.QuoteMeta(filter.Prefix)}
+		query["$or"] = []bson.M{{"client_id": prefix}, {"client_name": prefix}}
+	}
+	if filter.Address != "" {
+		query["address"] = filter.Address
+	}
+	if filter.Disabled != nil && *filter.Disabled {
+		query["disabled"] = true
+	} else if filter.Disabled != nil {
+		query["disabled"] = bson.M{"$ne": true}
+	}
+
+	clients := []Client{}
+	err = db.C(clientCol).Find(query).Sort("client_id").Limit(filter.Limit).All(&clients)
+	return clients, err
+}
+
+func (m *mongoStorage) insertClient(client *Client) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return mongoError(db.C(clientCol).Insert(client))
+}
+
+func (m *mongoStorage) saveClient(client *Client) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	_, err = db.C(clientCol).Upsert(bson.M{"client_id": client.Client_Id}, client)
+	return err
+}
+
+func (m *mongoStorage) deleteClient(client_id string) (int, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	err = db.C(clientCol).Remove(bson.M{"client_id": client_id})
+	if err != nil {
+		return 0, mongoError(err)
+	}
+	info, err := db.C(accessTokenCol).RemoveAll(bson.M{"client_id": client_id})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// insertToken inserts and then removes, as mgo has no multi-document transactions; tokens issued to the client
+// concurrently may briefly take it over keep, and are removed when it is next issued one
+func (m *mongoStorage) insertToken(accessToken *AccessToken, keep int) (int, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	c := db.C(accessTokenCol)
+
+	if err = c.Insert(accessToken); err != nil || keep <= 0 {
+		return 0, mongoError(err)
+	}
+	oldest := []struct {
+		Id bson.ObjectId `bson:"_id"`
+	}{}
+	err = c.Find(bson.M{"client_id": accessToken.Client_Id}).Sort("-_id").Skip(keep).Select(bson.M{"_id": 1}).All(&oldest)
+	if err != nil || len(oldest) == 0 {
+		return 0, err
+	}
+	ids := []bson.ObjectId{}
+	for _, token := range oldest {
+		ids = append(ids, token.Id)
+	}
+	info, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (m *mongoStorage) findToken(value string) (*AccessToken, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	stored := &AccessToken{}
+	err = db.C(accessTokenCol).Find(accessTokenQuery(value)).One(stored)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return stored, nil
+}
+
+// query is the MongoDB query matching the filter
+func (filter tokenFilter) query() bson.M {
+	query := bson.M{}
+	if filter.Client_Id != "" {
+		query["client_id"] = filter.Client_Id
+	}
+	if filter.Address != "" {
+		query["address"] = filter.Address
+	}
+	if filter.Ids != nil {
+		query["_id"] = bson.M{"$in": filter.Ids}
+	}
+	return query
+}
+
+func (m *mongoStorage) listTokens(filter tokenFilter, limit int) ([]AccessToken, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	tokens := []AccessToken{}
+	err = db.C(accessTokenCol).Find(filter.query()).Sort("-_id").Limit(limit).All(&tokens)
+	return tokens, err
+}
+
+func (m *mongoStorage) removeTokens(filter tokenFilter) (int, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	info, err := db.C(accessTokenCol).RemoveAll(filter.query())
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+func (m *mongoStorage) saveToken(accessToken *AccessToken) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if accessToken.Id == "" {
+		accessToken.Id = bson.NewObjectId()
+	}
+	accessToken.Expires_At = accessToken.expiresAt()
+	_, err = db.C(accessTokenCol).UpsertId(accessToken.Id, accessToken)
+	return err
+}
+
+func (m *mongoStorage) countTokens(ctx context.Context) (map[string]int, error) {
+	session, db, err := m.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	results := []struct {
+		Token_Type string `bson:"_id"`
+		Count      int    `bson:"count"`
+	}{}
+	pipeline := []bson.M{{"$group": bson.M{"_id": "$token_type", "count": bson.M{"$sum": 1}}}}
+	err = db.C(accessTokenCol).Pipe(pipeline).All(&results)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, result := range results {
+		counts[result.Token_Type] = result.Count
+	}
+	return counts, nil
+}
+
+func (m *mongoStorage) insertPushedRequest(pushed *PushedRequest) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return mongoError(db.C(pushedRequestCol).Insert(pushed))
+}
+
+func (m *mongoStorage) findPushedRequest(requestUri string) (*PushedRequest, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	pushed := &PushedRequest{}
+	err = db.C(pushedRequestCol).Find(bson.M{"_id": requestUri, "used": false, "expires": bson.M{"$gt": time.Now()}}).One(pushed)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return pushed, nil
+}
+
+func (m *mongoStorage) usePushedRequest(requestUri string) (*PushedRequest, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	pushed := &PushedRequest{}
+	change := mgo.Change{Update: bson.M{"$set": bson.M{"used": true}}}
+	_, err = db.C(pushedRequestCol).Find(bson.M{"_id": requestUri, "used": false, "expires": bson.M{"$gt": time.Now()}}).Apply(change, pushed)
+	if err != nil {
+		return nil, mongoError(err)
+	}
+	return pushed, nil
+}
+
+func (m *mongoStorage) insertDPoPNonce(nonce string, created time.Time) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return mongoError(db.C(dpopNonceCol).Insert(&DPoPNonce{Nonce: nonce, Created: created}))
+}
+
+func (m *mongoStorage) dpopNonceIssued(nonce string, oldest time.Time) (bool, error) {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+	numResults, err := db.C(dpopNonceCol).Find(bson.M{"_id": nonce, "created": bson.M{"$gte": oldest}}).Count()
+	return numResults > 0, err
+}
+
+// insertDPoPJti uses the proof as the document ID, so a replayed proof fails the insert
+func (m *mongoStorage) insertDPoPJti(id string, created time.Time) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return mongoError(db.C(dpopJtiCol).Insert(&DPoPJti{Id: id, Created: created}))
+}
+
+// insertRequestObjectJti uses the client ID and jti as the document ID, so a replayed request object fails the insert
+func (m *mongoStorage) insertRequestObjectJti(id string, expires time.Time) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return mongoError(db.C(requestObjectJtiCol).Insert(&RequestObjectJti{Id: id, Expires: expires}))
+}
+
+// appendAudit has instances race to insert the next sequence number; the loser reads the new end of
+// the log and tries again
+func (m *mongoStorage) appendAudit(entry *AuditEntry) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	c := db.C(auditCol)
+
+	for attempt := 0; attempt < auditRetries; attempt++ {
+		last := &AuditEntry{}
+		err = c.Find(nil).Sort("-_id").One(last)
+		if err == mgo.ErrNotFound {
+			last = &AuditEntry{}
+		} else if err != nil {
+			return err
+		}
+
+		entry.chain(last)
+		err = c.Insert(entry)
+		if !mgo.IsDup(err) {
+			return err
+		}
+	}
+	return errors.New("audit log is too busy, gave up after " + fmt.Sprint(auditRetries) + " attempts")
+}
+
+func (m *mongoStorage) eachAuditEntry(fn func(entry *AuditEntry) error) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	entry := &AuditEntry{}
+	iter := db.C(auditCol).Find(nil).Sort("_id").Iter()
+	for iter.Next(entry) {
+		if err = fn(entry); err != nil {
+			iter.Close()
+			return err
+		}
+		entry = &AuditEntry{}
+	}
+	return iter.Close()
+}
+
+func (m *mongoStorage) rateLimits() limiterStore {
+	return &mongoLimiter{}
+}
+
+// prepare creates the indexes and runs pending migrations
+// Each index and migration is reported to report when it is not nil; changes are also logged
+func (m *mongoStorage) prepare(report io.Writer, dryRun bool) error {
+	session, db, err := m.session(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	changes, err := ensureIndexes(db, dryRun)
+	for _, change := range changes {
+		if report != nil {
+			fmt.Fprintf(report, "%s\t%s\t%s\n", change.Collection, change.Index, change.Action)
+		}
+		if change.Action == "created" || change.Action == "updated" {
+			logger.Info("Index "+change.Action, "collection", change.Collection, "index", change.Index)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	results, err := runMigrations(db, dryRun)
+	reportMigrations(report, migrationCol, results)
+	return err
+}
+
+func (m *mongoStorage) pendingMigrations(ctx context.Context) ([]string, error) {
+	session, db, err := m.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	pending, err := pendingMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, m := range pending {
+		names = append(names, fmt.Sprintf("%d %s", m.version, m.name))
+	}
+	return names, nil
+}
+
+func (m *mongoStorage) ping(ctx context.Context) error {
+	session, _, err := m.session(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Ping()
+}
+
+func (m *mongoStorage) close() {
+	closeDatabase()
+}
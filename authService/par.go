@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/imryano/utils/random"
+)
+
+const pushedRequestCol string = "pushedRequests"
+
+const requestUriPrefix string = "urn:ietf:params:oauth:request_uri:"
+
+var errPARRequired = errors.New("client must use a pushed authorization request")
+
+type PushedRequest struct {
+	Request_Uri string             `bson:"_id"`
+	Request     AccessTokenRequest `bson:"request"`
+	Expires     time.Time          `bson:"expires"`
+	Used        bool               `bson:"used"`
+}
+
+type PushedRequestResponse struct {
+	Request_Uri string `json:"request_uri"`
+	Expires_In  int    `json:"expires_in"`
+}
+
+// PushAuthorisationRequest stores a client's token request parameters (RFC 9126)
+// The client must authenticate with its client id and address
+// Returns a single use request_uri to send to /getaccesstoken instead of the parameters
+func pushAuthorisationRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	atr := &AccessTokenRequest{}
+	err := json.NewDecoder(r.Body).Decode(atr)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if !allowAuthentication(w, r, atr.Client_Id) {
+		return
+	}
+	if atr.Request_Uri != "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "request_uri cannot be pushed")
+		return
+	}
+
+	//A pushed request object is validated now so only plain parameters are stored
+	err = atr.resolveRequestObject()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request_object", err.Error())
+		return
+	}
+	err = atr.resolveAddress(r)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	if !checkClientExists(atr.Address, atr.Client_Id) || atr.authenticateClient(r) != nil {
+		authFailed(r, atr.Client_Id)
+		audit(r, auditAuthFailed, atr.Client_Id, atr.Client_Id, map[string]string{"endpoint": "par", "reason": "client authentication failed"})
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	}
+	if !allowClient(w, r, atr.Client_Id) {
+		return
+	}
+	err = atr.consumeRequest()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request_object", err.Error())
+		return
+	}
+
+	pushed, err := createPushedRequest(*atr)
+	if err != nil {
+		logAttrs(r, slog.String("error", err.Error()))
+		http.Error(w, "Could not store request", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(&PushedRequestResponse{Request_Uri: pushed.Request_Uri, Expires_In: config.PAR.Lifetime})
+}
+
+// CreatePushedRequest stores the request and generates its request_uri
+func createPushedRequest(atr AccessTokenRequest) (*PushedRequest, error) {
+	reference, err := random.GenerateRandomString(config.Tokens.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	pushed := &PushedRequest{
+		Request_Uri: requestUriPrefix + reference,
+		Request:     atr,
+		Expires:     time.Now().Add(time.Duration(config.PAR.Lifetime) * time.Second),
+	}
+	err = store.insertPushedRequest(pushed)
+	if err != nil {
+		return nil, err
+	}
+	return pushed, nil
+}
+
+// UsePushedRequest marks the pushed request as used and returns it
+// Fails if the request_uri is unknown, expired or has already been used
+func usePushedRequest(requestUri string) (*PushedRequest, error) {
+	pushed, err := store.usePushedRequest(requestUri)
+	if err != nil {
+		return nil, errors.New("request_uri is invalid, expired or already used")
+	}
+	return pushed, nil
+}
+
+// FindPushedRequest returns the pushed request without using it
+// Fails if the request_uri is unknown, expired or has already been used
+func findPushedRequest(requestUri string) (*PushedRequest, error) {
+	pushed, err := store.findPushedRequest(requestUri)
+	if err != nil {
+		return nil, errors.New("request_uri is invalid, expired or already used")
+	}
+	return pushed, nil
+}
+
+// ClientRequiresPAR checks whether the client may only use pushed authorization requests
+func clientRequiresPAR(client_id string) bool {
+	client, err := store.findClient(client_id)
+	return err == nil && client.Require_Par
+}
+
+// resolveRequestUri replaces the request parameters with the ones pushed to /par
+// The request_uri is not used up until consumeRequest, so a request rejected by a later check, such as
+// a DPoP proof without the nonce, can be sent again with the same request_uri
+// Other request_uri values are left for resolveRequestObject
+// Requests without a pushed request_uri are rejected for clients that require PAR
+func (atr *AccessTokenRequest) resolveRequestUri() error {
+	if !strings.HasPrefix(atr.Request_Uri, requestUriPrefix) {
+		if clientRequiresPAR(atr.Client_Id) {
+			return errPARRequired
+		}
+		return nil
+	}
+
+	pushed, err := findPushedRequest(atr.Request_Uri)
+	if err != nil {
+		return err
+	}
+	if pushed.Request.Client_Id != atr.Client_Id {
+		return errors.New("request_uri was pushed by a different client")
+	}
+
+	jkt := atr.Jkt
+	*atr = pushed.Request
+	atr.Jkt = jkt
+	atr.pushedRequestUri = pushed.Request_Uri
+	return nil
+}
+
+// consumeRequest uses up the pushed request_uri and the signed request object the request was resolved from,
+// once every other check has passed
+// Only one of several requests racing with the same request_uri or request object succeeds
+func (atr *AccessTokenRequest) consumeRequest() error {
+	if atr.requestObjectJti != "" {
+		err := store.insertRequestObjectJti(atr.requestObjectJti, atr.requestObjectExpires)
+		if err == errDuplicate {
+			return errors.New("request object has already been used")
+		} else if err != nil {
+			return err
+		}
+	}
+	if atr.pushedRequestUri == "" {
+		return nil
+	}
+	_, err := usePushedRequest(atr.pushedRequestUri)
+	return err
+}
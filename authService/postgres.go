@@ -0,0 +1,823 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/imryano/utils/random"
+	"github.com/lib/pq"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// postgresMigrationLock is the advisory lock key held while migrating, so only one instance migrates at a time
+const postgresMigrationLock int64 = 0x6175746853766300
+
+// postgresStorage keeps everything in the PostgreSQL database at database.url, in the tables created by postgresMigrations
+// PostgreSQL has no TTL indexes, so a worker deletes expired rows every minute; reads ignore them until then
+type postgresStorage struct {
+	db *sql.DB
+}
+
+// postgresMigration is one change to the PostgreSQL schema
+// Versions are permanent: add new migrations to the end of postgresMigrations and never renumber or remove one
+type postgresMigration struct {
+	version    int
+	name       string
+	statements string
+}
+
+// postgresMigrations are applied in order, each once per database, and recorded in schema_migrations
+var postgresMigrations = []postgresMigration{
+	{1, "create_tables", `
+		CREATE TABLE clients (
+			id text PRIMARY KEY,
+			client_id text NOT NULL UNIQUE,
+			address text NOT NULL DEFAULT '',
+			binding_key text UNIQUE,
+			client_name text NOT NULL DEFAULT '',
+			require_par boolean NOT NULL DEFAULT false,
+			require_signed_request boolean NOT NULL DEFAULT false,
+			allowed_resources text[],
+			allowed_addresses text[],
+			client_secret_hash text NOT NULL DEFAULT '',
+			registration_token_hash text NOT NULL DEFAULT '',
+			disabled boolean NOT NULL DEFAULT false,
+			created timestamptz,
+			metadata jsonb NOT NULL DEFAULT '{}'
+		);
+		CREATE INDEX clients_address ON clients (address);
+
+		CREATE TABLE access_tokens (
+			id text PRIMARY KEY,
+			client_id text NOT NULL,
+			address text NOT NULL DEFAULT '',
+			access_token_hash text UNIQUE,
+			refresh_token_hash text,
+			token_type text NOT NULL,
+			expires integer NOT NULL,
+			jkt text NOT NULL DEFAULT '',
+			aud text[],
+			scope text NOT NULL DEFAULT '',
+			allowed_addresses text[],
+			created timestamptz,
+			expires_at timestamptz NOT NULL
+		);
+		CREATE INDEX access_tokens_client ON access_tokens (client_id, address);
+		CREATE INDEX access_tokens_expires_at ON access_tokens (expires_at);
+
+		CREATE TABLE pushed_requests (
+			request_uri text PRIMARY KEY,
+			request jsonb NOT NULL,
+			signed boolean NOT NULL DEFAULT false,
+			expires timestamptz NOT NULL,
+			used boolean NOT NULL DEFAULT false
+		);
+		CREATE INDEX pushed_requests_expires ON pushed_requests (expires);
+
+		CREATE TABLE dpop_nonces (nonce text PRIMARY KEY, created timestamptz NOT NULL);
+		CREATE INDEX dpop_nonces_created ON dpop_nonces (created);
+		CREATE TABLE dpop_jtis (id text PRIMARY KEY, created timestamptz NOT NULL);
+		CREATE INDEX dpop_jtis_created ON dpop_jtis (created);
+
+		CREATE TABLE audit_log (
+			seq bigint PRIMARY KEY,
+			time timestamptz NOT NULL,
+			event text NOT NULL,
+			actor text NOT NULL DEFAULT '',
+			client_id text NOT NULL DEFAULT '',
+			address text NOT NULL DEFAULT '',
+			request_id text NOT NULL DEFAULT '',
+			details jsonb,
+			prev_hash text NOT NULL,
+			hash text NOT NULL
+		);
+
+		CREATE TABLE rate_limits (
+			key text PRIMARY KEY,
+			tokens double precision NOT NULL DEFAULT 0,
+			updated timestamptz,
+			expires timestamptz
+		);
+		CREATE INDEX rate_limits_expires ON rate_limits (expires);
+		CREATE TABLE lockouts (
+			key text PRIMARY KEY,
+			failures integer NOT NULL DEFAULT 0,
+			last_failure timestamptz,
+			locked_until timestamptz,
+			expires timestamptz
+		);
+		CREATE INDEX lockouts_expires ON lockouts (expires);
+	`},
+	{2, "create_request_object_jtis", `
+		CREATE TABLE request_object_jtis (id text PRIMARY KEY, expires timestamptz NOT NULL);
+		CREATE INDEX request_object_jtis_expires ON request_object_jtis (expires);
+	`},
+}
+
+// openPostgres connects to the database at url
+func openPostgres(url string) (*postgresStorage, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStorage{db: db}, nil
+}
+
+// sweep deletes the rows that have expired by now, as TTL indexes do in MongoDB
+// Returns the number of rows deleted
+func (p *postgresStorage) sweep(now time.Time) (int, error) {
+	deleted := 0
+	for _, expiry := range []struct {
+		table  string
+		column string
+		before time.Time
+	}{
+		{"access_tokens", "expires_at", now},
+		{"pushed_requests", "expires", now},
+		{"dpop_nonces", "created", now.Add(-time.Duration(config.DPoP.Nonce_Lifetime) * time.Second)},
+		{"dpop_jtis", "created", now.Add(-dpopJtiLifetime)},
+		{"request_object_jtis", "expires", now},
+		{"rate_limits", "expires", now},
+		{"lockouts", "expires", now},
+	} {
+		result, err := p.db.Exec("DELETE FROM "+expiry.table+" WHERE "+expiry.column+" <= $1", expiry.before)
+		if err != nil {
+			return deleted, fmt.Errorf("%s: %s", expiry.table, err)
+		}
+		rows, _ := result.RowsAffected()
+		deleted += int(rows)
+	}
+	return deleted, nil
+}
+
+// postgresError translates the driver's errors into errNotFound and errDuplicate
+func postgresError(err error) error {
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return errDuplicate
+	}
+	return err
+}
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// nullString stores a blank value as NULL, so unique columns only compare values that are set
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func nullTime(value time.Time) sql.NullTime {
+	return sql.NullTime{Time: value, Valid: !value.IsZero()}
+}
+
+// objectId reads back an ID stored as hex
+func objectId(hex string) bson.ObjectId {
+	if bson.IsObjectIdHex(hex) {
+		return bson.ObjectIdHex(hex)
+	}
+	return ""
+}
+
+const clientColumns string = "id, client_id, address, binding_key, client_name, require_par, require_signed_request, " +
+	"allowed_resources, allowed_addresses, client_secret_hash, registration_token_hash, disabled, created, metadata"
+
+func scanClient(row rowScanner) (*Client, error) {
+	client := &Client{}
+	var id, clientName string
+	var bindingKey sql.NullString
+	var created sql.NullTime
+	var metadata []byte
+	err := row.Scan(&id, &client.Client_Id, &client.Address, &bindingKey, &clientName, &client.Require_Par,
+		&client.Require_Signed_Request, pq.Array(&client.Allowed_Resources), pq.Array(&client.Allowed_Addresses),
+		&client.Client_Secret_Hash, &client.Registration_Token_Hash, &client.Disabled, &created, &metadata)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	client.Id = objectId(id)
+	client.Binding_Key = bindingKey.String
+	client.Created = created.Time
+	return client, json.Unmarshal(metadata, &client.ClientMetadata)
+}
+
+// clientValues are the values of clientColumns for the client, giving it an ID if it has none
+func clientValues(client *Client) ([]interface{}, error) {
+	if client.Id == "" {
+		client.Id = bson.NewObjectId()
+	}
+	metadata, err := json.Marshal(client.ClientMetadata)
+	return []interface{}{client.Id.Hex(), client.Client_Id, client.Address, nullString(client.Binding_Key), client.Client_Name,
+		client.Require_Par, client.Require_Signed_Request, pq.Array(client.Allowed_Resources), pq.Array(client.Allowed_Addresses),
+		client.Client_Secret_Hash, client.Registration_Token_Hash, client.Disabled, nullTime(client.Created), metadata}, err
+}
+
+// placeholders returns $from to $to, comma separated
+func placeholders(from int, to int) string {
+	list := []string{}
+	for i := from; i <= to; i++ {
+		list = append(list, fmt.Sprintf("$%d", i))
+	}
+	return strings.Join(list, ", ")
+}
+
+func (p *postgresStorage) queryClient(where string, args ...interface{}) (*Client, error) {
+	return scanClient(p.db.QueryRow("SELECT "+clientColumns+" FROM clients WHERE "+where, args...))
+}
+
+// bindClient inserts with ON CONFLICT on the unique binding_key, so of several concurrent requests one creates
+// the client and the others find it on their next attempt
+func (p *postgresStorage) bindClient(address string) (*Client, bool, error) {
+	key := "address:" + address
+	for attempt := 0; attempt < 3; attempt++ {
+		client, err := p.queryClient("binding_key = $1", key)
+		if err != errNotFound {
+			return client, false, err
+		}
+
+		client = &Client{Address: address, Binding_Key: key, Created: time.Now()}
+		client.Client_Id, err = random.GenerateRandomString(config.Tokens.Length)
+		if err != nil {
+			return nil, false, err
+		}
+		values, err := clientValues(client)
+		if err != nil {
+			return nil, false, err
+		}
+		result, err := p.db.Exec("INSERT INTO clients ("+clientColumns+") VALUES ("+placeholders(1, len(values))+
+			") ON CONFLICT (binding_key) DO NOTHING", values...)
+		if postgresError(err) == errDuplicate {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		if inserted, _ := result.RowsAffected(); inserted > 0 {
+			return client, true, nil
+		}
+	}
+	return nil, false, errors.New("could not create a client for " + address)
+}
+
+func (p *postgresStorage) findClient(client_id string) (*Client, error) {
+	return p.queryClient("client_id = $1", client_id)
+}
+
+func (p *postgresStorage) listClients(filter clientFilter) ([]Client, error) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	if filter.Prefix != "" {
+		args = append(args, filter.Prefix)
+		where = append(where, fmt.Sprintf("(left(client_id, length($%d)) = $%[1]d OR left(client_name, length($%[1]d)) = $%[1]d)", len(args)))
+	}
+	if filter.Address != "" {
+		args = append(args, filter.Address)
+		where = append(where, fmt.Sprintf("address = $%d", len(args)))
+	}
+	if filter.Disabled != nil {
+		args = append(args, *filter.Disabled)
+		where = append(where, fmt.Sprintf("disabled = $%d", len(args)))
+	}
+	query := "SELECT " + clientColumns + " FROM clients WHERE " + strings.Join(where, " AND ") + " ORDER BY client_id"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	clients := []Client{}
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *client)
+	}
+	return clients, rows.Err()
+}
+
+func (p *postgresStorage) insertClient(client *Client) error {
+	values, err := clientValues(client)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("INSERT INTO clients ("+clientColumns+") VALUES ("+placeholders(1, len(values))+")", values...)
+	return postgresError(err)
+}
+
+// saveClient keeps the stored client's ID when it replaces it
+func (p *postgresStorage) saveClient(client *Client) error {
+	values, err := clientValues(client)
+	if err != nil {
+		return err
+	}
+	updates := []string{}
+	for _, column := range strings.Split(clientColumns, ", ")[2:] {
+		updates = append(updates, column+" = EXCLUDED."+column)
+	}
+	_, err = p.db.Exec("INSERT INTO clients ("+clientColumns+") VALUES ("+placeholders(1, len(values))+
+		") ON CONFLICT (client_id) DO UPDATE SET "+strings.Join(updates, ", "), values...)
+	return postgresError(err)
+}
+
+// deleteClient removes the client and its tokens in one transaction
+func (p *postgresStorage) deleteClient(client_id string) (int, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM clients WHERE client_id = $1", client_id)
+	if err != nil {
+		return 0, err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return 0, errNotFound
+	}
+	result, err = tx.Exec("DELETE FROM access_tokens WHERE client_id = $1", client_id)
+	if err != nil {
+		return 0, err
+	}
+	removed, _ := result.RowsAffected()
+	return int(removed), tx.Commit()
+}
+
+const tokenColumns string = "id, client_id, address, access_token_hash, refresh_token_hash, token_type, expires, " +
+	"jkt, aud, scope, allowed_addresses, created, expires_at"
+
+func scanToken(row rowScanner) (*AccessToken, error) {
+	accessToken := &AccessToken{}
+	var id string
+	var accessTokenHash, refreshTokenHash sql.NullString
+	var created sql.NullTime
+	err := row.Scan(&id, &accessToken.Client_Id, &accessToken.Address, &accessTokenHash, &refreshTokenHash,
+		&accessToken.Token_Type, &accessToken.Expires, &accessToken.Jkt, pq.Array(&accessToken.Aud), &accessToken.Scope,
+		pq.Array(&accessToken.Allowed_Addresses), &created, &accessToken.Expires_At)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	accessToken.Id = objectId(id)
+	accessToken.Access_Token_Hash = accessTokenHash.String
+	accessToken.Refresh_Token_Hash = refreshTokenHash.String
+	accessToken.Created = created.Time
+	return accessToken, nil
+}
+
+// tokenValues are the values of tokenColumns for the token, which are hashed as they are in MongoDB
+// The token is given an ID if it has none
+func tokenValues(accessToken *AccessToken) []interface{} {
+	if accessToken.Id == "" {
+		accessToken.Id = bson.NewObjectId()
+	}
+	stored := accessToken.withHashes()
+	return []interface{}{stored.Id.Hex(), stored.Client_Id, stored.Address, nullString(stored.Access_Token_Hash),
+		nullString(stored.Refresh_Token_Hash), stored.Token_Type, stored.Expires, stored.Jkt, pq.Array(stored.Aud),
+		stored.Scope, pq.Array(stored.Allowed_Addresses), nullTime(stored.Created), stored.expiresAt()}
+}
+
+// where returns the SQL condition matching the filter and its arguments
+func (filter tokenFilter) where() (string, []interface{}) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	if filter.Client_Id != "" {
+		args = append(args, filter.Client_Id)
+		where = append(where, fmt.Sprintf("client_id = $%d", len(args)))
+	}
+	if filter.Address != "" {
+		args = append(args, filter.Address)
+		where = append(where, fmt.Sprintf("address = $%d", len(args)))
+	}
+	if filter.Ids != nil {
+		ids := []string{}
+		for _, id := range filter.Ids {
+			ids = append(ids, id.Hex())
+		}
+		args = append(args, pq.Array(ids))
+		where = append(where, fmt.Sprintf("id = ANY($%d)", len(args)))
+	}
+	return strings.Join(where, " AND "), args
+}
+
+// insertToken locks the client's row first, so concurrent requests for one client trim its tokens one at a time
+func (p *postgresStorage) insertToken(accessToken *AccessToken, keep int) (int, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT 1 FROM clients WHERE client_id = $1 FOR UPDATE", accessToken.Client_Id)
+	if err != nil {
+		return 0, err
+	}
+	values := tokenValues(accessToken)
+	_, err = tx.Exec("INSERT INTO access_tokens ("+tokenColumns+") VALUES ("+placeholders(1, len(values))+")", values...)
+	if err != nil {
+		return 0, postgresError(err)
+	}
+	var removed int64
+	if keep > 0 {
+		result, err := tx.Exec(`DELETE FROM access_tokens WHERE id IN
+			(SELECT id FROM access_tokens WHERE client_id = $1 ORDER BY id DESC OFFSET $2)`, accessToken.Client_Id, keep)
+		if err != nil {
+			return 0, err
+		}
+		removed, _ = result.RowsAffected()
+	}
+	return int(removed), tx.Commit()
+}
+
+func (p *postgresStorage) findToken(value string) (*AccessToken, error) {
+	return scanToken(p.db.QueryRow("SELECT "+tokenColumns+" FROM access_tokens WHERE access_token_hash = $1 AND expires_at > $2",
+		hashToken(value), time.Now()))
+}
+
+func (p *postgresStorage) listTokens(filter tokenFilter, limit int) ([]AccessToken, error) {
+	where, args := filter.where()
+	query := "SELECT " + tokenColumns + " FROM access_tokens WHERE " + where + " ORDER BY id DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []AccessToken{}
+	for rows.Next() {
+		accessToken, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *accessToken)
+	}
+	return tokens, rows.Err()
+}
+
+func (p *postgresStorage) removeTokens(filter tokenFilter) (int, error) {
+	where, args := filter.where()
+	result, err := p.db.Exec("DELETE FROM access_tokens WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	removed, _ := result.RowsAffected()
+	return int(removed), nil
+}
+
+func (p *postgresStorage) saveToken(accessToken *AccessToken) error {
+	values := tokenValues(accessToken)
+	updates := []string{}
+	for _, column := range strings.Split(tokenColumns, ", ")[1:] {
+		updates = append(updates, column+" = EXCLUDED."+column)
+	}
+	_, err := p.db.Exec("INSERT INTO access_tokens ("+tokenColumns+") VALUES ("+placeholders(1, len(values))+
+		") ON CONFLICT (id) DO UPDATE SET "+strings.Join(updates, ", "), values...)
+	return postgresError(err)
+}
+
+func (p *postgresStorage) countTokens(ctx context.Context) (map[string]int, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT token_type, count(*) FROM access_tokens GROUP BY token_type")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{}
+	for rows.Next() {
+		var token_type string
+		var count int
+		if err = rows.Scan(&token_type, &count); err != nil {
+			return nil, err
+		}
+		counts[token_type] = count
+	}
+	return counts, rows.Err()
+}
+
+// insertPushedRequest stores the request as JSON, without the client secret it may have been pushed with
+func (p *postgresStorage) insertPushedRequest(pushed *PushedRequest) error {
+	request := pushed.Request
+	request.Client_Secret = ""
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec("INSERT INTO pushed_requests (request_uri, request, signed, expires) VALUES ($1, $2, $3, $4)",
+		pushed.Request_Uri, data, request.Signed, pushed.Expires)
+	return postgresError(err)
+}
+
+// scanPushedRequest reads the request, signed and expires columns of a pushed request
+func scanPushedRequest(row rowScanner, pushed *PushedRequest) (*PushedRequest, error) {
+	var data []byte
+	err := row.Scan(&data, &pushed.Request.Signed, &pushed.Expires)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	signed := pushed.Request.Signed
+	err = json.Unmarshal(data, &pushed.Request)
+	pushed.Request.Signed = signed
+	return pushed, err
+}
+
+func (p *postgresStorage) findPushedRequest(requestUri string) (*PushedRequest, error) {
+	return scanPushedRequest(p.db.QueryRow(`SELECT request, signed, expires FROM pushed_requests
+		WHERE request_uri = $1 AND NOT used AND expires > $2`, requestUri, time.Now()), &PushedRequest{Request_Uri: requestUri})
+}
+
+func (p *postgresStorage) usePushedRequest(requestUri string) (*PushedRequest, error) {
+	return scanPushedRequest(p.db.QueryRow(`UPDATE pushed_requests SET used = true WHERE request_uri = $1 AND NOT used AND expires > $2
+		RETURNING request, signed, expires`, requestUri, time.Now()), &PushedRequest{Request_Uri: requestUri, Used: true})
+}
+
+func (p *postgresStorage) insertDPoPNonce(nonce string, created time.Time) error {
+	_, err := p.db.Exec("INSERT INTO dpop_nonces (nonce, created) VALUES ($1, $2)", nonce, created)
+	return postgresError(err)
+}
+
+func (p *postgresStorage) dpopNonceIssued(nonce string, oldest time.Time) (bool, error) {
+	var issued bool
+	err := p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM dpop_nonces WHERE nonce = $1 AND created >= $2)", nonce, oldest).Scan(&issued)
+	return issued, err
+}
+
+// insertDPoPJti uses the proof as the primary key, so a replayed proof fails the insert
+func (p *postgresStorage) insertDPoPJti(id string, created time.Time) error {
+	_, err := p.db.Exec("INSERT INTO dpop_jtis (id, created) VALUES ($1, $2)", id, created)
+	return postgresError(err)
+}
+
+// insertRequestObjectJti uses the client ID and jti as the primary key, so a replayed request object fails the insert
+func (p *postgresStorage) insertRequestObjectJti(id string, expires time.Time) error {
+	_, err := p.db.Exec("INSERT INTO request_object_jtis (id, expires) VALUES ($1, $2)", id, expires)
+	return postgresError(err)
+}
+
+const auditColumns string = "seq, time, event, actor, client_id, address, request_id, details, prev_hash, hash"
+
+func scanAuditEntry(row rowScanner) (*AuditEntry, error) {
+	entry := &AuditEntry{}
+	var details []byte
+	err := row.Scan(&entry.Seq, &entry.Time, &entry.Event, &entry.Actor, &entry.Client_Id, &entry.Address,
+		&entry.Request_Id, &details, &entry.Prev_Hash, &entry.Hash)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	if details != nil {
+		err = json.Unmarshal(details, &entry.Details)
+	}
+	return entry, err
+}
+
+// appendAudit locks the audit log against other appends until the entry is committed, so entries are
+// numbered in the order they are written; reads are not blocked
+func (p *postgresStorage) appendAudit(entry *AuditEntry) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("LOCK TABLE audit_log IN SHARE ROW EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+	last, err := scanAuditEntry(tx.QueryRow("SELECT " + auditColumns + " FROM audit_log ORDER BY seq DESC LIMIT 1"))
+	if err == errNotFound {
+		last = &AuditEntry{}
+	} else if err != nil {
+		return err
+	}
+
+	entry.chain(last)
+	var details []byte
+	if entry.Details != nil {
+		details, err = json.Marshal(entry.Details)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO audit_log ("+auditColumns+") VALUES ("+placeholders(1, 10)+")", entry.Seq, entry.Time,
+		entry.Event, entry.Actor, entry.Client_Id, entry.Address, entry.Request_Id, details, entry.Prev_Hash, entry.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *postgresStorage) eachAuditEntry(fn func(entry *AuditEntry) error) error {
+	rows, err := p.db.Query("SELECT " + auditColumns + " FROM audit_log ORDER BY seq")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (p *postgresStorage) rateLimits() limiterStore {
+	return &postgresLimiter{db: p.db}
+}
+
+// appliedPostgresMigrations returns the recorded migration versions
+// A database without schema_migrations has none applied
+func appliedPostgresMigrations(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}) (map[int]bool, error) {
+	applied := map[int]bool{}
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&exists)
+	if err != nil || !exists {
+		return applied, err
+	}
+	rows, err := q.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		if err = rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// prepare applies the pending migrations in one transaction, so a failure leaves the schema as it was
+// The transaction holds an advisory lock, so an instance starting while another migrates gets errMigrationsLocked
+func (p *postgresStorage) prepare(report io.Writer, dryRun bool) error {
+	ctx := context.Background()
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if !dryRun {
+		var locked bool
+		err = tx.QueryRow("SELECT pg_try_advisory_xact_lock($1)", postgresMigrationLock).Scan(&locked)
+		if err != nil {
+			return err
+		} else if !locked {
+			return errMigrationsLocked
+		}
+		_, err = tx.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name text NOT NULL, applied timestamptz NOT NULL)")
+		if err != nil {
+			return err
+		}
+	}
+
+	//Read what has been applied once the lock is held, in case another instance finished first
+	applied, err := appliedPostgresMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	results := []migrationResult{}
+	for _, m := range postgresMigrations {
+		result := migrationResult{Version: m.version, Name: m.name, Action: "already applied"}
+		if !applied[m.version] && dryRun {
+			result.Action = "pending"
+		} else if !applied[m.version] {
+			_, err = tx.Exec(m.statements)
+			if err == nil {
+				_, err = tx.Exec("INSERT INTO schema_migrations (version, name, applied) VALUES ($1, $2, $3)", m.version, m.name, time.Now())
+			}
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %s", m.version, m.name, err)
+			}
+			result.Action = "applied"
+		}
+		results = append(results, result)
+	}
+	if !dryRun {
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	reportMigrations(report, "schema_migrations", results)
+	return nil
+}
+
+func (p *postgresStorage) pendingMigrations(ctx context.Context) ([]string, error) {
+	applied, err := appliedPostgresMigrations(ctx, p.db)
+	if err != nil {
+		return nil, err
+	}
+	pending := []string{}
+	for _, m := range postgresMigrations {
+		if !applied[m.version] {
+			pending = append(pending, fmt.Sprintf("%d %s", m.version, m.name))
+		}
+	}
+	return pending, nil
+}
+
+func (p *postgresStorage) ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
+
+func (p *postgresStorage) close() {
+	p.db.Close()
+}
+
+// postgresLimiter keeps limits in PostgreSQL so they hold across instances
+// Each update locks the row, so instances take turns instead of retrying
+type postgresLimiter struct {
+	db *sql.DB
+}
+
+// lockRow starts a transaction holding the row for key in table, inserting a blank row if there is none
+func (limiter *postgresLimiter) lockRow(table string, key string, columns string, dest ...interface{}) (*sql.Tx, error) {
+	tx, err := limiter.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("INSERT INTO "+table+" (key) VALUES ($1) ON CONFLICT DO NOTHING", key)
+	if err == nil {
+		err = tx.QueryRow("SELECT "+columns+" FROM "+table+" WHERE key = $1 FOR UPDATE", key).Scan(dest...)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (limiter *postgresLimiter) take(key string, perMinute int, burst int) (time.Duration, error) {
+	defer observeStorage("rate_limit", time.Now())
+	b := &bucket{Key: key}
+	var updated sql.NullTime
+	tx, err := limiter.lockRow("rate_limits", key, "tokens, updated", &b.Tokens, &updated)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	b.Updated = updated.Time
+	wait := b.refill(time.Now(), perMinute, burst)
+	if wait > 0 {
+		return wait, nil
+	}
+	_, err = tx.Exec("UPDATE rate_limits SET tokens = $2, updated = $3, expires = $4 WHERE key = $1", key, b.Tokens, b.Updated, b.Expires)
+	if err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit()
+}
+
+func (limiter *postgresLimiter) locked(key string) (time.Duration, error) {
+	var lockedUntil sql.NullTime
+	err := limiter.db.QueryRow("SELECT locked_until FROM lockouts WHERE key = $1", key).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return positive(time.Until(lockedUntil.Time)), err
+}
+
+func (limiter *postgresLimiter) fail(key string) (time.Duration, error) {
+	l := &lockout{Key: key}
+	var lastFailure, lockedUntil sql.NullTime
+	tx, err := limiter.lockRow("lockouts", key, "failures, last_failure, locked_until", &l.Failures, &lastFailure, &lockedUntil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	l.Last_Failure = lastFailure.Time
+	l.Locked_Until = lockedUntil.Time
+	duration := l.fail(time.Now())
+	_, err = tx.Exec("UPDATE lockouts SET failures = $2, last_failure = $3, locked_until = $4, expires = $5 WHERE key = $1",
+		key, l.Failures, l.Last_Failure, nullTime(l.Locked_Until), l.Expires)
+	if err != nil {
+		return 0, err
+	}
+	return duration, tx.Commit()
+}
+
+func (limiter *postgresLimiter) reset(key string) error {
+	_, err := limiter.db.Exec("DELETE FROM lockouts WHERE key = $1", key)
+	return err
+}
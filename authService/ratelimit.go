@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const rateLimitCol string = "rateLimits"
+const lockoutCol string = "lockouts"
+
+// limiterRetries is how many times a database limiter update is retried after losing a race with another instance
+const limiterRetries int = 5
+
+// contendedWait is how long a caller waits when its bucket is changing too fast to update, which only happens under a flood
+const contendedWait time.Duration = time.Second
+
+var errLimiterContended = errors.New("lockout is changing too fast to update")
+
+// limiterStore keeps rate limit buckets and lockouts, for this instance or shared between instances
+type limiterStore interface {
+	// take removes a token from the bucket for key, returning how long to wait if it is empty
+	take(key string, perMinute int, burst int) (time.Duration, error)
+	// locked returns how much longer key is locked out for
+	locked(key string) (time.Duration, error)
+	// fail records a failed authentication for key, returning the lockout it started if any
+	fail(key string) (time.Duration, error)
+	// reset clears the failures recorded for key
+	reset(key string) error
+}
+
+// bucket is a token bucket, refilled at perMinute tokens a minute up to burst
+type bucket struct {
+	Key     string    `bson:"_id"`
+	Tokens  float64   `bson:"tokens"`
+	Updated time.Time `bson:"updated"`
+	Expires time.Time `bson:"expires"`
+}
+
+// lockout counts failed authentications; once rate_limit.lockout_threshold is reached each further
+// failure locks the key out, for twice as long as the last time up to rate_limit.lockout_max
+type lockout struct {
+	Key          string    `bson:"_id"`
+	Failures     int       `bson:"failures"`
+	Last_Failure time.Time `bson:"last_failure"`
+	Locked_Until time.Time `bson:"locked_until"`
+	Expires      time.Time `bson:"expires"`
+}
+
+// memoryLimiter keeps limits for this instance only
+type memoryLimiter struct {
+	mutex    sync.Mutex
+	buckets  map[string]*bucket
+	lockouts map[string]*lockout
+}
+
+// mongoLimiter keeps limits in MongoDB so they hold across instances
+// Expired documents are removed by TTL indexes on expires
+type mongoLimiter struct{}
+
+// limiter is nil when rate limiting is disabled
+var limiter limiterStore
+
+func newLimiter(settings RateLimitConfig) limiterStore {
+	if !settings.Enabled {
+		return nil
+	}
+	if settings.Store == "database" {
+		return store.rateLimits()
+	}
+	memory := &memoryLimiter{buckets: map[string]*bucket{}, lockouts: map[string]*lockout{}}
+	workers.start("rate limit cleanup", func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				memory.cleanup(time.Now())
+			}
+		}
+	})
+	return memory
+}
+
+// refill adds the tokens earned since the bucket was last updated and takes one if it can
+// Returns how long until a token is available if the bucket is empty
+func (b *bucket) refill(now time.Time, perMinute int, burst int) time.Duration {
+	perSecond := float64(perMinute) / 60
+	if b.Updated.IsZero() {
+		b.Tokens = float64(burst)
+	} else {
+		b.Tokens = math.Min(float64(burst), b.Tokens+now.Sub(b.Updated).Seconds()*perSecond)
+	}
+	b.Updated = now
+	b.Expires = now.Add(time.Duration(float64(burst)/perSecond) * time.Second)
+	if b.Tokens < 1 {
+		return time.Duration((1 - b.Tokens) / perSecond * float64(time.Second))
+	}
+	b.Tokens--
+	return 0
+}
+
+// fail records a failure, forgetting earlier failures once rate_limit.lockout_max has passed since the last one
+func (l *lockout) fail(now time.Time) time.Duration {
+	maxLockout := time.Duration(config.Rate_Limit.Lockout_Max) * time.Second
+	if now.Sub(l.Last_Failure) > maxLockout {
+		l.Failures = 0
+	}
+	l.Failures++
+	l.Last_Failure = now
+	l.Expires = now.Add(maxLockout)
+
+	over := l.Failures - config.Rate_Limit.Lockout_Threshold
+	if over < 0 {
+		return 0
+	}
+	duration := time.Duration(config.Rate_Limit.Lockout_Duration) * time.Second
+	for i := 0; i < over && duration < maxLockout; i++ {
+		duration *= 2
+	}
+	if duration > maxLockout {
+		duration = maxLockout
+	}
+	l.Locked_Until = now.Add(duration)
+	l.Expires = l.Locked_Until.Add(maxLockout)
+	return duration
+}
+
+func (memory *memoryLimiter) take(key string, perMinute int, burst int) (time.Duration, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	b, ok := memory.buckets[key]
+	if !ok {
+		b = &bucket{Key: key}
+		memory.buckets[key] = b
+	}
+	return b.refill(time.Now(), perMinute, burst), nil
+}
+
+func (memory *memoryLimiter) locked(key string) (time.Duration, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	if l, ok := memory.lockouts[key]; ok {
+		return positive(time.Until(l.Locked_Until)), nil
+	}
+	return 0, nil
+}
+
+func (memory *memoryLimiter) fail(key string) (time.Duration, error) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	l, ok := memory.lockouts[key]
+	if !ok {
+		l = &lockout{Key: key}
+		memory.lockouts[key] = l
+	}
+	return l.fail(time.Now()), nil
+}
+
+func (memory *memoryLimiter) reset(key string) error {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	delete(memory.lockouts, key)
+	return nil
+}
+
+// cleanup forgets full buckets and expired lockouts so spraying addresses cannot exhaust memory
+func (memory *memoryLimiter) cleanup(now time.Time) {
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	for key, b := range memory.buckets {
+		if now.After(b.Expires) {
+			delete(memory.buckets, key)
+		}
+	}
+	for key, l := range memory.lockouts {
+		if now.After(l.Expires) {
+			delete(memory.lockouts, key)
+		}
+	}
+}
+
+// collection returns a limiter collection
+func (database *mongoLimiter) collection(session *mgo.Session, name string) *mgo.Collection {
+	return session.DB(config.Database.Name).C(name)
+}
+
+// take updates the bucket only if no other instance has since updated it, retrying if one has
+// A bucket still contended after limiterRetries is treated as empty
+func (database *mongoLimiter) take(key string, perMinute int, burst int) (time.Duration, error) {
+	defer observeStorage("rate_limit", time.Now())
+	session, err := openDatabase()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	c := database.collection(session, rateLimitCol)
+
+	for attempt := 0; attempt < limiterRetries; attempt++ {
+		b := &bucket{}
+		err = c.FindId(key).One(b)
+		if err == mgo.ErrNotFound {
+			b = &bucket{Key: key}
+			wait := b.refill(time.Now().Truncate(time.Millisecond), perMinute, burst)
+			err = c.Insert(b)
+			if mgo.IsDup(err) {
+				continue
+			}
+			return wait, err
+		} else if err != nil {
+			return 0, err
+		}
+
+		previous := b.Updated
+		wait := b.refill(time.Now().Truncate(time.Millisecond), perMinute, burst)
+		if wait > 0 {
+			return wait, nil
+		}
+		err = c.Update(bson.M{"_id": key, "updated": previous}, b)
+		if err != mgo.ErrNotFound {
+			return 0, err
+		}
+	}
+	return contendedWait, nil
+}
+
+func (database *mongoLimiter) locked(key string) (time.Duration, error) {
+	session, err := openDatabase()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	l := &lockout{}
+	err = database.collection(session, lockoutCol).FindId(key).One(l)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return positive(time.Until(l.Locked_Until)), err
+}
+
+func (database *mongoLimiter) fail(key string) (time.Duration, error) {
+	session, err := openDatabase()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	c := database.collection(session, lockoutCol)
+
+	for attempt := 0; attempt < limiterRetries; attempt++ {
+		l := &lockout{}
+		err = c.FindId(key).One(l)
+		if err == mgo.ErrNotFound {
+			l = &lockout{Key: key}
+			duration := l.fail(time.Now().Truncate(time.Millisecond))
+			err = c.Insert(l)
+			if mgo.IsDup(err) {
+				continue
+			}
+			return duration, err
+		} else if err != nil {
+			return 0, err
+		}
+
+		previous := l.Last_Failure
+		duration := l.fail(time.Now().Truncate(time.Millisecond))
+		err = c.Update(bson.M{"_id": key, "last_failure": previous}, l)
+		if err != mgo.ErrNotFound {
+			return duration, err
+		}
+	}
+	return 0, errLimiterContended
+}
+
+func (database *mongoLimiter) reset(key string) error {
+	session, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	err = database.collection(session, lockoutCol).RemoveId(key)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// rateLimited applies the per-address rate limit and lockout before handler
+func rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowAddress(w, r) {
+			handler(w, r)
+		}
+	}
+}
+
+// authoriseLimited applies the /authorise rate limit for the request's source address before handler
+// Resource servers call /authorise for every request they serve, so it has its own limit rather than the address limit
+func authoriseLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil || checkRate(w, r, "authorise:"+clientAddress(r), "authorise", config.Rate_Limit.Authorise_Per_Minute, config.Rate_Limit.Authorise_Burst) {
+			handler(w, r)
+		}
+	}
+}
+
+// allowAddress applies the rate limit and lockout for the request's source address
+// Writes a 429 response and returns false if the caller has to wait
+func allowAddress(w http.ResponseWriter, r *http.Request) bool {
+	if limiter == nil {
+		return true
+	}
+	address := clientAddress(r)
+	return checkLockout(w, r, "address:"+address) &&
+		checkRate(w, r, "address:"+address, "address", config.Rate_Limit.Address_Per_Minute, config.Rate_Limit.Address_Burst)
+}
+
+// allowAuthentication applies the lockout for the client at the request's source address, before it authenticates
+func allowAuthentication(w http.ResponseWriter, r *http.Request, client_id string) bool {
+	return limiter == nil || client_id == "" || checkLockout(w, r, clientLockoutKey(r, client_id))
+}
+
+// allowClient applies the client's rate limit
+// Call it only once the client has authenticated, so a caller naming someone else's client_id cannot use up its limit
+func allowClient(w http.ResponseWriter, r *http.Request, client_id string) bool {
+	if limiter == nil || client_id == "" {
+		return true
+	}
+	return checkRate(w, r, "client:"+client_id, "client", config.Rate_Limit.Client_Per_Minute, config.Rate_Limit.Client_Burst)
+}
+
+// authFailed records a failed client authentication against the source address, and against the
+// client at that address so an attacker elsewhere cannot lock a client out
+func authFailed(r *http.Request, client_id string) {
+	if limiter == nil {
+		return
+	}
+	keys := []string{"address:" + clientAddress(r)}
+	if client_id != "" {
+		keys = append(keys, clientLockoutKey(r, client_id))
+	}
+	for _, key := range keys {
+		recordFailure(r, key, client_id)
+	}
+}
+
+// allowValidation applies the /authorise lockout for the request's source address
+func allowValidation(w http.ResponseWriter, r *http.Request) bool {
+	return limiter == nil || checkLockout(w, r, validationLockoutKey(r))
+}
+
+// validationFailed records a token rejected at /authorise against the source address, so tokens cannot be guessed
+// The client_id sent with a token is not authenticated, so failures are never counted against it: anyone could lock
+// the client out by sending bad tokens in its name
+// The key is kept apart from the address lockout so a resource server passing on bad tokens can still get its own
+func validationFailed(r *http.Request) {
+	if limiter != nil {
+		recordFailure(r, validationLockoutKey(r), "")
+	}
+}
+
+// validationSucceeded clears the failures validationFailed recorded for the source address, so a resource server
+// passing on an occasional bad token from its callers is not locked out; guesses stay bounded by the /authorise rate
+func validationSucceeded(r *http.Request) {
+	if limiter != nil {
+		if err := limiter.reset(validationLockoutKey(r)); err != nil {
+			requestLogger(r).Error("Could not clear failed validations", "error", err)
+		}
+	}
+}
+
+// recordFailure counts a failure against key, auditing the lockout if it starts one
+func recordFailure(r *http.Request, key string, client_id string) {
+	duration, err := limiter.fail(key)
+	if err != nil {
+		requestLogger(r).Error("Could not record failed authentication", "key", key, "error", err)
+	} else if duration > 0 {
+		audit(r, auditLockout, "", client_id, map[string]string{"key": key, "seconds": strconv.Itoa(int(duration.Seconds()))})
+	}
+}
+
+// authSucceeded clears the client's failures at the source address
+// Failures counted against the address itself only expire, so a caller cannot clear them with a client of its own
+func authSucceeded(r *http.Request, client_id string) {
+	if limiter != nil {
+		if err := limiter.reset(clientLockoutKey(r, client_id)); err != nil {
+			requestLogger(r).Error("Could not clear failed authentications", "client_id", client_id, "error", err)
+		}
+	}
+}
+
+// checkLockout rejects the request if key is locked out
+// Limiter errors let the request through, so a database problem does not lock everyone out
+func checkLockout(w http.ResponseWriter, r *http.Request, key string) bool {
+	wait, err := limiter.locked(key)
+	if err != nil {
+		requestLogger(r).Error("Could not check lockout", "key", key, "error", err)
+		return true
+	}
+	if wait > 0 {
+		rateLimitedRequests.WithLabelValues("lockout").Inc()
+		writeTooManyRequests(w, wait, "Too many failed authentication attempts")
+		return false
+	}
+	return true
+}
+
+func checkRate(w http.ResponseWriter, r *http.Request, key string, limit string, perMinute int, burst int) bool {
+	wait, err := limiter.take(key, perMinute, burst)
+	if err != nil {
+		requestLogger(r).Error("Could not check rate limit", "key", key, "error", err)
+		return true
+	}
+	if wait > 0 {
+		rateLimitedRequests.WithLabelValues(limit).Inc()
+		writeTooManyRequests(w, wait, "Rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration, description string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeOAuthError(w, http.StatusTooManyRequests, "too_many_requests", description)
+}
+
+func clientLockoutKey(r *http.Request, client_id string) string {
+	return "client:" + client_id + "@" + clientAddress(r)
+}
+
+func validationLockoutKey(r *http.Request) string {
+	return "authorise:" + clientAddress(r)
+}
+
+func positive(duration time.Duration) time.Duration {
+	if duration < 0 {
+		return 0
+	}
+	return duration
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/imryano/OAuth/authPackage"
+	"github.com/imryano/utils/random"
+)
+
+const registrationPath string = "/register"
+
+var supportedGrantTypes = []string{"client_credentials"}
+var supportedAuthMethods = []string{"none", "client_secret_basic", "client_secret_post"}
+
+// ClientMetadata is the client metadata accepted by /register (RFC 7591 section 2)
+type ClientMetadata struct {
+	Client_Name                string                       `json:"client_name,omitempty" bson:"client_name,omitempty"`
+	Redirect_Uris              []string                     `json:"redirect_uris,omitempty" bson:"redirect_uris,omitempty"`
+	Grant_Types                []string                     `json:"grant_types,omitempty" bson:"grant_types,omitempty"`
+	Scope                      string                       `json:"scope,omitempty" bson:"scope,omitempty"`
+	Jwks                       *authorisation.JSONWebKeySet `json:"jwks,omitempty" bson:"jwks,omitempty"`
+	Request_Uris               []string                     `json:"request_uris,omitempty" bson:"request_uris,omitempty"`
+	Token_Endpoint_Auth_Method string                       `json:"token_endpoint_auth_method,omitempty" bson:"token_endpoint_auth_method,omitempty"`
+}
+
+// ClientRegistrationRequest is the body of a registration create or update request
+type ClientRegistrationRequest struct {
+	ClientMetadata
+	Client_Id     string `json:"client_id,omitempty"`
+	Client_Secret string `json:"client_secret,omitempty"`
+	Address       string `json:"address,omitempty"`
+	//Allowed_Addresses binds the client to IP addresses and CIDRs instead of Address; * allows any address
+	Allowed_Addresses []string `json:"allowed_addresses,omitempty"`
+}
+
+// ClientRegistrationResponse is the client information response (RFC 7591 section 3.2.1)
+type ClientRegistrationResponse struct {
+	ClientMetadata
+	Client_Id                 string `json:"client_id"`
+	Client_Secret             string `json:"client_secret,omitempty"`
+	Client_Id_Issued_At       int64  `json:"client_id_issued_at"`
+	Client_Secret_Expires_At  int64  `json:"client_secret_expires_at"`
+	Registration_Access_Token string `json:"registration_access_token,omitempty"`
+	Registration_Client_Uri   string `json:"registration_client_uri"`
+}
+
+// RegisterClient creates a client from the posted metadata (RFC 7591)
+// Requires the initial access token as a bearer token if one is configured
+// Returns the client credentials and a registration access token for managing the registration
+func registerClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if config.Registration.Initial_Access_Token != "" && !secretsEqual(bearerToken(r), config.Registration.Initial_Access_Token) {
+		authFailed(r, "")
+		audit(r, auditAuthFailed, "", "", map[string]string{"endpoint": "register", "reason": "invalid initial access token"})
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "A valid initial access token is required")
+		return
+	}
+
+	registration := &ClientRegistrationRequest{}
+	err := json.NewDecoder(r.Body).Decode(registration)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", err.Error())
+		return
+	}
+	err = registration.ClientMetadata.validateRegistration()
+	if err == nil {
+		err = validateAddressPatterns(registration.Allowed_Addresses)
+	}
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", err.Error())
+		return
+	}
+
+	client := &Client{ClientMetadata: registration.ClientMetadata, Address: normalizeAddress(registration.Address), Allowed_Addresses: registration.Allowed_Addresses, Created: time.Now()}
+	if client.Address == "" {
+		client.Address = clientAddress(r)
+	}
+
+	response, err := createRegisteredClient(client)
+	if err != nil {
+		logAttrs(r, slog.String("error", err.Error()))
+		http.Error(w, "Could not register client", http.StatusInternalServerError)
+		return
+	}
+	audit(r, auditClientRegistered, response.Client_Id, response.Client_Id, map[string]string{"endpoint": "register", "client_name": client.Client_Name})
+
+	writeRegistration(w, http.StatusCreated, response)
+}
+
+// ManageRegistration reads, updates or deletes a registration (RFC 7592)
+// The client is identified by the path and authenticated by its registration access token
+func manageRegistration(w http.ResponseWriter, r *http.Request) {
+	client_id := strings.TrimPrefix(r.URL.Path, registrationPath+"/")
+	client, err := store.findClient(client_id)
+	if err != nil || !secretsEqual(hashSecret(bearerToken(r)), client.Registration_Token_Hash) {
+		authFailed(r, client_id)
+		audit(r, auditAuthFailed, "", client_id, map[string]string{"endpoint": "register", "reason": "invalid registration access token"})
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "Invalid registration access token")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeRegistration(w, http.StatusOK, client.registrationResponse())
+	case "PUT":
+		registration := &ClientRegistrationRequest{}
+		err := json.NewDecoder(r.Body).Decode(registration)
+		if err == nil && registration.Client_Id != client.Client_Id {
+			err = errors.New("client_id does not match the registration")
+		}
+		if err == nil && registration.Client_Secret != "" && !secretsEqual(hashSecret(registration.Client_Secret), client.Client_Secret_Hash) {
+			err = errors.New("client_secret does not match the registration")
+		}
+		if err == nil {
+			err = registration.ClientMetadata.validateRegistration()
+		}
+		if err != nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_client_metadata", err.Error())
+			return
+		}
+
+		client.ClientMetadata = registration.ClientMetadata
+		response, err := updateRegisteredClient(client)
+		if err != nil {
+			logAttrs(r, slog.String("error", err.Error()))
+			http.Error(w, "Could not update client", http.StatusInternalServerError)
+			return
+		}
+		audit(r, auditClientUpdated, client.Client_Id, client.Client_Id, map[string]string{"endpoint": "register"})
+		writeRegistration(w, http.StatusOK, response)
+	case "DELETE":
+		err := deleteRegisteredClient(client)
+		if err != nil {
+			logAttrs(r, slog.String("error", err.Error()))
+			http.Error(w, "Could not delete client", http.StatusInternalServerError)
+			return
+		}
+		audit(r, auditClientDeleted, client.Client_Id, client.Client_Id, map[string]string{"endpoint": "register"})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validate checks the metadata values are ones this server supports
+// Blank values are replaced with their defaults
+func (metadata *ClientMetadata) validate() error {
+	if metadata.Token_Endpoint_Auth_Method == "" {
+		metadata.Token_Endpoint_Auth_Method = "client_secret_basic"
+	}
+	if !containsString(supportedAuthMethods, metadata.Token_Endpoint_Auth_Method) {
+		return errors.New("unsupported token_endpoint_auth_method: " + metadata.Token_Endpoint_Auth_Method)
+	}
+
+	if len(metadata.Grant_Types) == 0 {
+		metadata.Grant_Types = []string{"client_credentials"}
+	}
+	for _, grantType := range metadata.Grant_Types {
+		if !containsString(supportedGrantTypes, grantType) {
+			return errors.New("unsupported grant_type: " + grantType)
+		}
+	}
+
+	for _, uri := range append(append([]string{}, metadata.Redirect_Uris...), metadata.Request_Uris...) {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return errors.New("URIs must be absolute without a fragment: " + uri)
+		}
+	}
+	//authService fetches request_uris itself, see fetchRequestObject
+	for _, uri := range metadata.Request_Uris {
+		if u, _ := url.Parse(uri); u.Scheme != "https" {
+			return errors.New("request_uris must use https: " + uri)
+		}
+	}
+
+	if metadata.Jwks != nil {
+		for i := range metadata.Jwks.Keys {
+			_, err := metadata.Jwks.Keys[i].PublicKey()
+			if err != nil {
+				return err
+			}
+			if metadata.Jwks.Keys[i].D != "" {
+				return errors.New("jwks must not contain private keys")
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateRegistration is validate for metadata a client registers itself
+// Clients cannot give themselves the admin scope
+func (metadata *ClientMetadata) validateRegistration() error {
+	if hasScope(metadata.Scope, adminScope) {
+		return errors.New("the admin scope cannot be registered")
+	}
+	return metadata.validate()
+}
+
+// CreateRegisteredClient generates the client's credentials and inserts it
+// The secret and registration access token are only stored as hashes
+func createRegisteredClient(client *Client) (*ClientRegistrationResponse, error) {
+	var err error
+	client.Client_Id, err = random.GenerateRandomString(config.Tokens.Length)
+	if err != nil {
+		return nil, err
+	}
+	secret, registrationToken, err := client.generateCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.insertClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	response := client.registrationResponse()
+	response.Client_Secret = secret
+	response.Registration_Access_Token = registrationToken
+	return response, nil
+}
+
+// UpdateRegisteredClient saves the client's new metadata and rotates its registration access token
+// A client switching to "none" loses its secret, and one switching from "none" to a secret method is given a secret
+func updateRegisteredClient(client *Client) (*ClientRegistrationResponse, error) {
+	secret := ""
+	if client.Token_Endpoint_Auth_Method == "none" {
+		client.Client_Secret_Hash = ""
+	} else if client.Client_Secret_Hash == "" {
+		var err error
+		secret, err = authorisation.GenerateToken(authorisation.ClientSecretType, config.Tokens.Length)
+		if err != nil {
+			return nil, err
+		}
+		client.Client_Secret_Hash = hashSecret(secret)
+	}
+
+	registrationToken, err := authorisation.GenerateToken(authorisation.RegistrationAccessTokenType, config.Tokens.Length)
+	if err != nil {
+		return nil, err
+	}
+	client.Registration_Token_Hash = hashSecret(registrationToken)
+
+	err = store.saveClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	response := client.registrationResponse()
+	response.Client_Secret = secret
+	response.Registration_Access_Token = registrationToken
+	return response, nil
+}
+
+// DeleteRegisteredClient removes the client and every token issued to it
+func deleteRegisteredClient(client *Client) error {
+	removed, err := store.deleteClient(client.Client_Id)
+	if err == nil {
+		tokensRevoked.WithLabelValues(clientLabel(client.Client_Id), "client_deleted").Add(float64(removed))
+	}
+	return err
+}
+
+// generateCredentials creates a client secret (unless the client uses no authentication) and a
+// registration access token, storing their hashes on the client
+func (client *Client) generateCredentials() (string, string, error) {
+	secret := ""
+	if client.Token_Endpoint_Auth_Method != "none" {
+		var err error
+		secret, err = authorisation.GenerateToken(authorisation.ClientSecretType, config.Tokens.Length)
+		if err != nil {
+			return "", "", err
+		}
+		client.Client_Secret_Hash = hashSecret(secret)
+	}
+
+	registrationToken, err := authorisation.GenerateToken(authorisation.RegistrationAccessTokenType, config.Tokens.Length)
+	if err != nil {
+		return "", "", err
+	}
+	client.Registration_Token_Hash = hashSecret(registrationToken)
+
+	return secret, registrationToken, nil
+}
+
+func (client *Client) registrationResponse() *ClientRegistrationResponse {
+	return &ClientRegistrationResponse{
+		ClientMetadata:          client.ClientMetadata,
+		Client_Id:               client.Client_Id,
+		Client_Id_Issued_At:     client.Created.Unix(),
+		Registration_Client_Uri: config.Issuer + registrationPath + "/" + client.Client_Id,
+	}
+}
+
+func writeRegistration(w http.ResponseWriter, status int, response *ClientRegistrationResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// authenticateClient checks the credentials required by the client's token_endpoint_auth_method
+// Clients without a registered method keep authenticating by address alone
+func (atr *AccessTokenRequest) authenticateClient(r *http.Request) error {
+	client, err := store.findClient(atr.Client_Id)
+	if err != nil {
+		//Unknown clients are rejected when the token is issued
+		return nil
+	}
+
+	switch client.Token_Endpoint_Auth_Method {
+	case "client_secret_basic":
+		id, secret, ok := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if !ok || id != client.Client_Id || !secretsEqual(hashSecret(secret), client.Client_Secret_Hash) {
+			return errors.New("client authentication failed")
+		}
+	case "client_secret_post":
+		if !secretsEqual(hashSecret(atr.Client_Secret), client.Client_Secret_Hash) {
+			return errors.New("client authentication failed")
+		}
+	}
+	return nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		return authorization[7:]
+	}
+	return ""
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// secretsEqual compares secrets in constant time; blank values never match
+func secretsEqual(a string, b string) bool {
+	return a != "" && b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+)
+
+// checkResources validates the requested resource indicators (RFC 8707)
+// Each resource must be an absolute URI in the client's allowed resource list
+// Clients with an allowed resource list must request at least one resource
+func (atr *AccessTokenRequest) checkResources() error {
+	for _, resource := range atr.Resource {
+		u, err := url.Parse(resource)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return errors.New("resource must be an absolute URI without a fragment: " + resource)
+		}
+	}
+
+	client, err := store.findClient(atr.Client_Id)
+	if err != nil {
+		//Unknown clients are rejected when the token is issued
+		return nil
+	}
+
+	if len(client.Allowed_Resources) == 0 {
+		if len(atr.Resource) > 0 {
+			return errors.New("client is not allowed to request resources")
+		}
+		return nil
+	}
+	if len(atr.Resource) == 0 {
+		return errors.New("client must request a resource")
+	}
+	for _, resource := range atr.Resource {
+		if !containsString(client.Allowed_Resources, resource) {
+			return errors.New("client is not allowed to request resource: " + resource)
+		}
+	}
+
+	atr.Resource = normaliseAudience(atr.Resource)
+	return nil
+}
+
+// normaliseAudience sorts and de-duplicates an audience so tokens can be matched on it exactly
+func normaliseAudience(aud []string) []string {
+	if len(aud) == 0 {
+		return nil
+	}
+	sorted := append([]string{}, aud...)
+	sort.Strings(sorted)
+	result := sorted[:1]
+	for _, value := range sorted[1:] {
+		if value != result[len(result)-1] {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// sameAudience reports whether two audiences hold the same resources
+func sameAudience(a []string, b []string) bool {
+	a = normaliseAudience(a)
+	b = normaliseAudience(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// audienceAllows reports whether a token with the audience aud may be presented to a resource
+// Tokens without an audience are unrestricted and valid for any resource
+// Tokens with an audience are only valid when presented with one of its resources
+func audienceAllows(aud []string, resource string) bool {
+	return len(aud) == 0 || (resource != "" && containsString(aud, resource))
+}
+
+// audienceValue returns the query value matching a token issued for exactly this audience
+func audienceValue(aud []string) interface{} {
+	if len(aud) == 0 {
+		return nil
+	}
+	return aud
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// adminScope grants access to the /admin API
+// It can only be given to a client through the admin API, never through self-registration
+const adminScope string = "admin"
+
+// checkScope validates the requested scope against the scope registered for the client
+// The granted scope is normalised so tokens can be matched on it exactly
+func (atr *AccessTokenRequest) checkScope() error {
+	if atr.Scope == "" {
+		return nil
+	}
+
+	client, err := store.findClient(atr.Client_Id)
+	if err != nil {
+		//Unknown clients are rejected when the token is issued
+		return nil
+	}
+
+	for _, scope := range strings.Fields(atr.Scope) {
+		if !hasScope(client.Scope, scope) {
+			return errors.New("client is not allowed to request scope: " + scope)
+		}
+	}
+
+	atr.Scope = normaliseScope(atr.Scope)
+	return nil
+}
+
+// hasScope reports whether a space separated scope string includes the given scope
+func hasScope(scopes string, scope string) bool {
+	return containsString(strings.Fields(scopes), scope)
+}
+
+// normaliseScope sorts and de-duplicates a space separated scope string
+func normaliseScope(scope string) string {
+	return strings.Join(normaliseAudience(strings.Fields(scope)), " ")
+}
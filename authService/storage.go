@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	errNotFound  = errors.New("not found")
+	errDuplicate = errors.New("already exists")
+)
+
+// storage keeps clients, tokens and the other state authService shares between instances
+// database.backend chooses the implementation: mongoStorage, postgresStorage or boltStorage
+// Every implementation must behave the same; the storage tests run against each
+type storage interface {
+	// bindClient returns the client bound to the address, creating it if there is none
+	// Concurrent calls for one address return the same client; the second value is whether it was created
+	bindClient(address string) (*Client, bool, error)
+	// findClient returns the client with the client ID, or errNotFound
+	findClient(client_id string) (*Client, error)
+	// listClients returns the clients matching the filter, ordered by client ID
+	listClients(filter clientFilter) ([]Client, error)
+	// insertClient stores a new client, or returns errDuplicate if its client ID is taken
+	insertClient(client *Client) error
+	// saveClient replaces the client with the same client ID, inserting it if there is none
+	saveClient(client *Client) error
+	// deleteClient removes the client and every token issued to it, returning the number of tokens removed
+	deleteClient(client_id string) (int, error)
+
+	// insertToken stores a new access token and, when keep is above 0, removes its client's oldest tokens beyond keep
+	// in the same transaction, returning how many were removed; token values are stored only as hashes
+	insertToken(accessToken *AccessToken, keep int) (int, error)
+	// findToken returns the unexpired token with the access token value, or errNotFound
+	// Tokens of the legacy format are found like any other: values saved in plaintext, as exports from earlier versions
+	// carry them, are hashed when saved, and MongoDB also matches documents earlier versions stored in plaintext
+	findToken(value string) (*AccessToken, error)
+	// listTokens returns up to limit tokens matching the filter, newest first; a limit of 0 returns them all
+	listTokens(filter tokenFilter, limit int) ([]AccessToken, error)
+	// removeTokens removes the tokens matching the filter, returning how many were removed
+	removeTokens(filter tokenFilter) (int, error)
+	// saveToken replaces the token with the same ID, inserting it if there is none
+	saveToken(accessToken *AccessToken) error
+	// countTokens counts the stored tokens by token type
+	countTokens(ctx context.Context) (map[string]int, error)
+
+	// insertPushedRequest stores a pushed authorization request
+	insertPushedRequest(pushed *PushedRequest) error
+	// findPushedRequest returns an unexpired, unused pushed request without using it, or returns errNotFound
+	findPushedRequest(requestUri string) (*PushedRequest, error)
+	// usePushedRequest marks an unexpired, unused pushed request as used and returns it, or returns errNotFound
+	usePushedRequest(requestUri string) (*PushedRequest, error)
+
+	// insertDPoPNonce records a nonce issued at created
+	insertDPoPNonce(nonce string, created time.Time) error
+	// dpopNonceIssued reports whether the nonce was issued at or after oldest
+	dpopNonceIssued(nonce string, oldest time.Time) (bool, error)
+	// insertDPoPJti records a DPoP proof, or returns errDuplicate if it has been seen before
+	insertDPoPJti(id string, created time.Time) error
+	// insertRequestObjectJti records a signed request object until it expires, or returns errDuplicate if it has been seen before
+	insertRequestObjectJti(id string, expires time.Time) error
+
+	// appendAudit adds the entry to the end of the audit log, setting its sequence number and hashes with chain
+	appendAudit(entry *AuditEntry) error
+	// eachAuditEntry calls fn with every audit log entry in sequence order, stopping at the first error
+	eachAuditEntry(fn func(entry *AuditEntry) error) error
+
+	// rateLimits returns a limiterStore that shares rate limits between instances through this storage
+	rateLimits() limiterStore
+
+	// prepare brings the schema and stored data up to date, reporting each step to report when it is not nil
+	// A dry run only reports what would be done
+	prepare(report io.Writer, dryRun bool) error
+	// pendingMigrations names the migrations not yet applied
+	pendingMigrations(ctx context.Context) ([]string, error)
+	// ping checks the database can be reached
+	ping(ctx context.Context) error
+	// close releases the connections once requests have finished with them
+	close()
+}
+
+// backupStorage is storage that can copy itself to a file while serving, for GET /admin/backup
+// Other backends are backed up with their database's own tools
+// backup calls size with the length of the copy before writing it
+type backupStorage interface {
+	backup(w io.Writer, size func(int64)) (int64, error)
+}
+
+// sweepStorage is storage without TTL indexes, whose expired records are deleted by sweep
+type sweepStorage interface {
+	// sweep deletes the records that have expired by now, returning how many were deleted
+	sweep(now time.Time) (int, error)
+}
+
+// store is the running storage; it is MongoDB until main opens the configured backend
+var store storage = &mongoStorage{}
+
+// newStorage opens the configured backend
+func newStorage(settings DatabaseConfig) (storage, error) {
+	if settings.Backend == "postgres" {
+		p, err := openPostgres(settings.Url)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if settings.Backend == "bolt" {
+		b, err := openBolt(settings.Url)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	return &mongoStorage{}, nil
+}
+
+// startExpirySweep deletes expired records every minute, for backends without TTL indexes
+// The server starts it once the database is prepared, as the sweep needs the tables migrations create
+func startExpirySweep() {
+	sweeper, ok := store.(sweepStorage)
+	if !ok {
+		return
+	}
+	workers.start("expiry sweep", func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := sweeper.sweep(time.Now()); err != nil {
+					logger.Warn("Could not remove expired records", "error", err)
+				}
+			}
+		}
+	})
+}
+
+// clientFilter selects clients for an admin listing
+type clientFilter struct {
+	// Prefix matches the start of the client ID or client name
+	Prefix   string
+	Address  string
+	Disabled *bool
+	Limit    int
+}
+
+// tokenFilter selects tokens; blank fields match any token
+type tokenFilter struct {
+	Client_Id string
+	Address   string
+	// Ids matches any of the IDs when it is not nil, so an empty list matches no token
+	Ids []bson.ObjectId
+}
+
+// chain numbers the entry to follow last, which is blank for the first entry, and hashes it
+func (entry *AuditEntry) chain(last *AuditEntry) {
+	entry.Seq = last.Seq + 1
+	entry.Prev_Hash = last.Hash
+	entry.Hash = entry.computeHash(auditKey())
+}
+
+// expiresAt is when the token expires; tokens imported without expires_at expire their lifetime after they were created
+func (at *AccessToken) expiresAt() time.Time {
+	if !at.Expires_At.IsZero() {
+		return at.Expires_At
+	}
+	created := at.Created
+	if created.IsZero() && at.Id.Valid() {
+		created = at.Id.Time()
+	}
+	return created.Add(time.Duration(at.Expires) * time.Second)
+}
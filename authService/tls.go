@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certReloader serves the certificate and key files, reloading them when they change or on SIGHUP
+// Established connections keep the certificate they were handshaken with, so a reload drops nothing
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	return reloader, reloader.reload()
+}
+
+// reload loads the certificate and key from disk
+// On failure the previous certificate stays in use
+func (reloader *certReloader) reload() error {
+	modTime, err := reloader.filesModTime()
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+		if err == nil {
+			reloader.mutex.Lock()
+			reloader.cert = &cert
+			reloader.modTime = modTime
+			reloader.mutex.Unlock()
+		}
+	}
+	return err
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (reloader *certReloader) filesModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, file := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// changed reports whether either file has been modified since the last successful load
+func (reloader *certReloader) changed() bool {
+	modTime, err := reloader.filesModTime()
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return err == nil && !modTime.Equal(reloader.modTime)
+}
+
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+	return reloader.cert, nil
+}
+
+// watch reloads the certificate when the files change, checking every interval, and on SIGHUP
+// Runs until stop is closed
+func (reloader *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangup:
+		case <-ticker.C:
+			if !reloader.changed() {
+				continue
+			}
+		}
+		if err := reloader.reload(); err != nil {
+			logger.Error("TLS certificate reload failed, keeping the current certificate", "cert_file", reloader.certFile, "error", err)
+		} else {
+			logger.Info("Reloaded TLS certificate", "cert_file", reloader.certFile)
+		}
+	}
+}
+
+// newTLSConfig builds the server TLS configuration, taking certificates from reloader
+func newTLSConfig(settings TLSConfig, reloader *certReloader) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[settings.Min_Version]
+	if !ok {
+		return nil, errors.New("tls.min_version must be 1.2 or 1.3")
+	}
+	cipherSuites, err := cipherSuiteIDs(settings.Cipher_Suites)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{MinVersion: minVersion, CipherSuites: cipherSuites}
+	if reloader != nil {
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	}
+	return tlsConfig, nil
+}
+
+// cipherSuiteIDs looks up cipher suites by their standard names
+// Only suites Go considers secure are accepted; TLS 1.3 suites are not configurable and are ignored by Go
+func cipherSuiteIDs(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ids := []uint16{}
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("tls.cipher_suites: unknown or insecure cipher suite " + name)
+		}
+	}
+	return ids, nil
+}
+
+// setupTLS loads the certificate into server and starts watching it for changes
+// Returns the plain HTTP redirect server when tls.redirect_listen is set
+func setupTLS(server *http.Server) (*http.Server, error) {
+	reloader, err := newCertReloader(config.TLS.Cert_File, config.TLS.Key_File)
+	if err != nil {
+		return nil, err
+	}
+	server.TLSConfig, err = newTLSConfig(config.TLS, reloader)
+	if err != nil {
+		return nil, err
+	}
+	addReadinessCheck("tls_certificate", certificateCheck(reloader))
+	workers.start("certificate reloader", func(stop <-chan struct{}) {
+		reloader.watch(time.Duration(config.TLS.Reload_Interval)*time.Second, stop)
+	})
+
+	if config.TLS.Redirect_Listen == "" {
+		return nil, nil
+	}
+	redirect := newServer(http.HandlerFunc(redirectToHTTPS))
+	redirect.Addr = config.TLS.Redirect_Listen
+	return redirect, nil
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS listener
+// 308 keeps the method and body, so API clients repeat POSTs rather than turning them into GETs
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	_, port, _ := net.SplitHostPort(config.Listen)
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
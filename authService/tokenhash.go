@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/imryano/OAuth/authPackage"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// hashToken is the keyed hash an access or refresh token is stored and looked up by
+// The key is tokens.pepper, which is kept out of the database so a dump alone cannot be used to check guesses
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(config.Tokens.Pepper))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// withHashes returns the token with the hashes of its values filled in, as it is stored
+func (at AccessToken) withHashes() AccessToken {
+	if at.Access_Token != "" {
+		at.Access_Token_Hash = hashToken(at.Access_Token)
+	}
+	if at.Refresh_Token != "" {
+		at.Refresh_Token_Hash = hashToken(at.Refresh_Token)
+	}
+	return at
+}
+
+// GetBSON stores the token values as hashes, whoever writes the token
+func (at AccessToken) GetBSON() (interface{}, error) {
+	type storedAccessToken AccessToken
+	return storedAccessToken(at.withHashes()), nil
+}
+
+// accessTokenFormatAccepted checks the token is an access token with a correct checksum, so mistyped
+// and truncated values are rejected without a database lookup
+// Tokens without a type prefix are issued by earlier versions and accepted while tokens.legacy_format is set
+func accessTokenFormatAccepted(token string) bool {
+	tokenType, err := authorisation.ParseToken(token)
+	if err == authorisation.ErrUnrecognisedToken {
+		return config.Tokens.Legacy_Format && token != ""
+	}
+	return err == nil && tokenType == authorisation.AccessTokenType
+}
+
+// accessTokenQuery matches an unexpired stored token by the hash of its value
+// Tokens stored in plaintext by earlier versions also match until the hash_stored_tokens migration has replaced them
+// Expired tokens are removed by a TTL index, but that runs only once a minute
+func accessTokenQuery(token string) bson.M {
+	return bson.M{
+		"$or":        []bson.M{{"access_token_hash": hashToken(token)}, {"access_token": token}},
+		"expires_at": bson.M{"$not": bson.M{"$lte": time.Now()}},
+	}
+}
+
+// hashStoredTokens replaces the plaintext values of tokens stored by earlier versions with their hashes
+// Returns the number of tokens hashed, or in a dry run the number that would be
+func hashStoredTokens(c *mgo.Collection, dryRun bool) (int, error) {
+	query := c.Find(bson.M{"$or": []bson.M{{"access_token": bson.M{"$exists": true}}, {"refresh_token": bson.M{"$exists": true}}}})
+	if dryRun {
+		return query.Count()
+	}
+	hashed := 0
+	stored := bson.M{}
+	iter := query.Iter()
+	for iter.Next(&stored) {
+		set := bson.M{}
+		if token, ok := stored["access_token"].(string); ok && token != "" {
+			set["access_token_hash"] = hashToken(token)
+		}
+		if token, ok := stored["refresh_token"].(string); ok && token != "" {
+			set["refresh_token_hash"] = hashToken(token)
+		}
+		update := bson.M{"$unset": bson.M{"access_token": "", "refresh_token": ""}}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if err := c.UpdateId(stored["_id"], update); err != nil {
+			iter.Close()
+			return hashed, err
+		}
+		hashed++
+		stored = bson.M{}
+	}
+	return hashed, iter.Close()
+}
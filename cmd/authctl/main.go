@@ -0,0 +1,391 @@
+// authctl administers an authService through its /admin API
+//
+// Connection settings are read from flags, falling back to the environment:
+//
+//	-server  AUTHCTL_SERVER  address of the authService (default http://127.0.0.1:8080)
+//	-token   AUTHCTL_TOKEN   access token with the admin scope
+//	-o       AUTHCTL_OUTPUT  output format, table or json (default table)
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultServer string = "http://127.0.0.1:8080"
+
+const usage string = `Usage: authctl [-server URL] [-token TOKEN] [-o table|json] COMMAND
+
+Commands:
+  clients list [-q PREFIX] [-address ADDRESS] [-disabled true|false]
+  clients get CLIENT_ID
+  clients register -name NAME [-address ADDRESS] [-scope SCOPE] [-auth-method METHOD]
+                   [-resources URI,...] [-allowed-addresses CIDR,...] [-require-par] [-require-signed-request]
+  clients disable|enable|delete CLIENT_ID
+  clients rotate-secret CLIENT_ID
+  clients rotate-keys -jwks FILE CLIENT_ID
+  tokens list CLIENT_ID
+  tokens get TOKEN_ID
+  tokens revoke [-client CLIENT_ID] [-address ADDRESS] [TOKEN_ID...]
+  tokens mint -client CLIENT_ID [-scope SCOPE] [-resources URI,...]
+  export [-file FILE]
+  import [-file FILE]
+  backup [-file FILE]
+`
+
+var clientColumns = []string{"client_id", "client_name", "address", "scope", "token_endpoint_auth_method", "disabled"}
+var tokenColumns = []string{"id", "client_id", "address", "token_type", "scope", "aud", "created"}
+
+// adminClient calls the /admin API of an authService
+type adminClient struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes one authctl command and returns the process exit code
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("authctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	server := flags.String("server", envOrDefault("AUTHCTL_SERVER", defaultServer), "authService address")
+	token := flags.String("token", os.Getenv("AUTHCTL_TOKEN"), "admin access token")
+	output := flags.String("o", envOrDefault("AUTHCTL_OUTPUT", "table"), "output format: table or json")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*output != "table" && *output != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	c := &adminClient{server: strings.TrimRight(*server, "/"), token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+	result, columns, err := c.runCommand(flags.Args(), stdin, stdout)
+	if err != nil {
+		fmt.Fprintln(stderr, "authctl:", err)
+		return 1
+	}
+	if result != nil {
+		err = printResult(stdout, *output, result, columns)
+		if err != nil {
+			fmt.Fprintln(stderr, "authctl:", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// runCommand dispatches a command to the admin API
+// Returns the decoded response and the columns to show it with in table output
+func (c *adminClient) runCommand(args []string, stdin io.Reader, stdout io.Writer) (interface{}, []string, error) {
+	name := args[0]
+	if len(args) > 1 && (name == "clients" || name == "tokens") {
+		name += " " + args[1]
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	var result interface{}
+
+	switch name {
+	case "clients list":
+		q := flags.String("q", "", "")
+		address := flags.String("address", "", "")
+		disabled := flags.String("disabled", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return nil, nil, err
+		}
+		query := url.Values{}
+		for key, value := range map[string]string{"q": *q, "address": *address, "disabled": *disabled} {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		err := c.do("GET", "clients?"+query.Encode(), nil, &result)
+		return result, clientColumns, err
+	case "clients get":
+		id, err := singleArg(flags, args)
+		if err == nil {
+			err = c.do("GET", "clients/"+url.PathEscape(id), nil, &result)
+		}
+		return result, nil, err
+	case "clients register":
+		request := map[string]interface{}{}
+		name := flags.String("name", "", "")
+		address := flags.String("address", "", "")
+		scope := flags.String("scope", "", "")
+		authMethod := flags.String("auth-method", "", "")
+		resources := flags.String("resources", "", "")
+		allowedAddresses := flags.String("allowed-addresses", "", "")
+		requirePar := flags.Bool("require-par", false, "")
+		requireSigned := flags.Bool("require-signed-request", false, "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return nil, nil, err
+		}
+		request["client_name"] = *name
+		request["address"] = *address
+		request["scope"] = *scope
+		request["token_endpoint_auth_method"] = *authMethod
+		request["allowed_resources"] = splitList(*resources)
+		request["allowed_addresses"] = splitList(*allowedAddresses)
+		request["require_par"] = *requirePar
+		request["require_signed_request"] = *requireSigned
+		err := c.do("POST", "clients", request, &result)
+		return result, nil, err
+	case "clients disable", "clients enable":
+		id, err := singleArg(flags, args)
+		if err == nil {
+			err = c.do("POST", "clients/"+url.PathEscape(id)+"/"+args[0], nil, &result)
+		}
+		return result, nil, err
+	case "clients delete":
+		id, err := singleArg(flags, args)
+		if err == nil {
+			err = c.do("DELETE", "clients/"+url.PathEscape(id), nil, nil)
+		}
+		return nil, nil, err
+	case "clients rotate-secret":
+		id, err := singleArg(flags, args)
+		if err == nil {
+			err = c.do("POST", "clients/"+url.PathEscape(id)+"/secret", nil, &result)
+		}
+		return result, nil, err
+	case "clients rotate-keys":
+		jwksFile := flags.String("jwks", "", "")
+		id, err := singleArg(flags, args)
+		if err == nil && *jwksFile == "" {
+			err = errors.New("clients rotate-keys needs -jwks FILE")
+		}
+		var jwks []byte
+		if err == nil {
+			jwks, err = ioutil.ReadFile(*jwksFile)
+		}
+		if err == nil {
+			err = c.do("PUT", "clients/"+url.PathEscape(id)+"/keys", json.RawMessage(jwks), &result)
+		}
+		return result, nil, err
+	case "tokens list":
+		id, err := singleArg(flags, args)
+		if err == nil {
+			err = c.do("GET", "clients/"+url.PathEscape(id)+"/tokens", nil, &result)
+		}
+		return result, tokenColumns, err
+	case "tokens get":
+		id, err := singleArg(flags, args)
+		if err == nil {
+			err = c.do("GET", "tokens/"+url.PathEscape(id), nil, &result)
+		}
+		return result, tokenColumns, err
+	case "tokens revoke":
+		client := flags.String("client", "", "")
+		address := flags.String("address", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return nil, nil, err
+		}
+		request := map[string]interface{}{"client_id": *client, "address": *address, "ids": flags.Args()}
+		if *client == "" && *address == "" && flags.NArg() == 0 {
+			return nil, nil, errors.New("tokens revoke needs -client, -address or token IDs")
+		}
+		err := c.do("POST", "tokens/revoke", request, &result)
+		return result, nil, err
+	case "tokens mint":
+		client := flags.String("client", "", "")
+		scope := flags.String("scope", "", "")
+		resources := flags.String("resources", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return nil, nil, err
+		}
+		request := map[string]interface{}{"client_id": *client, "scope": *scope, "resource": splitList(*resources)}
+		err := c.do("POST", "tokens", request, &result)
+		return result, nil, err
+	case "export":
+		file := flags.String("file", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return nil, nil, err
+		}
+		var data json.RawMessage
+		err := c.do("GET", "export", nil, &data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if *file == "" {
+			_, err = stdout.Write(append(data, '\n'))
+			return nil, nil, err
+		}
+		return nil, nil, ioutil.WriteFile(*file, data, 0600)
+	case "import":
+		file := flags.String("file", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return nil, nil, err
+		}
+		var data []byte
+		var err error
+		if *file == "" {
+			data, err = ioutil.ReadAll(stdin)
+		} else {
+			data, err = ioutil.ReadFile(*file)
+		}
+		if err == nil {
+			err = c.do("POST", "import", json.RawMessage(data), &result)
+		}
+		return result, nil, err
+	case "backup":
+		file := flags.String("file", "", "")
+		if err := flags.Parse(args[1:]); err != nil {
+			return nil, nil, err
+		}
+		if *file == "" {
+			return nil, nil, c.do("GET", "backup", nil, stdout)
+		}
+		f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = c.do("GET", "backup", nil, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*file)
+		}
+		return nil, nil, err
+	}
+
+	return nil, nil, errors.New("unknown command: " + name + "\n\n" + usage)
+}
+
+// do sends a request to the admin API and decodes the JSON response into result
+// A result that is an io.Writer is sent the response as it is, for responses that are not JSON
+func (c *adminClient) do(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(method, c.server+"/admin/"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if w, ok := result.(io.Writer); ok {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// printResult writes a decoded response as indented JSON or as a table
+// Lists are printed one row per item using columns; single objects as key/value rows
+func printResult(w io.Writer, output string, result interface{}, columns []string) error {
+	if output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	switch value := result.(type) {
+	case []interface{}:
+		fmt.Fprintln(table, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, item := range value {
+			row, _ := item.(map[string]interface{})
+			cells := []string{}
+			for _, column := range columns {
+				cells = append(cells, formatValue(row[column]))
+			}
+			fmt.Fprintln(table, strings.Join(cells, "\t"))
+		}
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(table, "%s\t%s\n", key, formatValue(value[key]))
+		}
+	default:
+		fmt.Fprintln(table, formatValue(value))
+	}
+	return table.Flush()
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, formatValue(item))
+		}
+		return strings.Join(items, ",")
+	case map[string]interface{}:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// singleArg parses a command that takes exactly one positional argument
+func singleArg(flags *flag.FlagSet, args []string) (string, error) {
+	err := flags.Parse(args[1:])
+	if err == nil && flags.NArg() != 1 {
+		err = errors.New(args[0] + " needs exactly one ID")
+	}
+	return flags.Arg(0), err
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func envOrDefault(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
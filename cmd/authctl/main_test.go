@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "FAKEADMINACCESSTOKEN"
+
+func getTestAdminServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAdminToken {
+			http.Error(w, `{"error":"insufficient_scope"}`, http.StatusForbidden)
+			return
+		}
+
+		switch r.Method + " " + r.URL.Path {
+		case "GET /admin/clients":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"client_id": "FAKECLIENTIDFIRST", "client_name": "Orders", "address": "123.123.123.123", "disabled": false},
+				{"client_id": "FAKECLIENTIDSECOND", "client_name": "Stock", "address": "69.69.69.69", "disabled": true},
+			})
+		case "POST /admin/tokens/revoke":
+			request := map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&request)
+			if request["client_id"] != "FAKECLIENTIDFIRST" {
+				t.Errorf("authctl failed: Revoke sent the wrong client_id (%v)", request["client_id"])
+			}
+			json.NewEncoder(w).Encode(map[string]int{"revoked": 3})
+		case "PUT /admin/clients/FAKECLIENTIDFIRST/keys":
+			jwks := map[string][]interface{}{}
+			if json.NewDecoder(r.Body).Decode(&jwks) != nil || len(jwks["keys"]) != 1 {
+				t.Errorf("authctl failed: rotate-keys did not send the key set")
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"client_id": "FAKECLIENTIDFIRST", "jwks": jwks})
+		case "GET /admin/backup":
+			w.Write([]byte("FAKEBACKUP"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestPassRunCommand(t *testing.T) {
+	server := getTestAdminServer(t)
+	defer server.Close()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := run([]string{"-server", server.URL, "-token", testAdminToken, "clients", "list"}, nil, stdout, stderr)
+	if code != 0 {
+		t.Fatalf("authctl failed: clients list exited with %d (%s)", code, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "CLIENT_ID") || !strings.Contains(lines[2], "FAKECLIENTIDSECOND") {
+		t.Errorf("authctl failed: clients list table was wrong:\n%s", stdout.String())
+	}
+
+	stdout.Reset()
+	code = run([]string{"-server", server.URL, "-token", testAdminToken, "-o", "json", "tokens", "revoke", "-client", "FAKECLIENTIDFIRST"}, nil, stdout, stderr)
+	result := map[string]int{}
+	if code != 0 || json.Unmarshal(stdout.Bytes(), &result) != nil || result["revoked"] != 3 {
+		t.Errorf("authctl failed: tokens revoke did not print the JSON result (%s%s)", stdout.String(), stderr.String())
+	}
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	ioutil.WriteFile(jwksFile, []byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"FAKEX","y":"FAKEY"}]}`), 0600)
+	code = run([]string{"-server", server.URL, "-token", testAdminToken, "clients", "rotate-keys", "-jwks", jwksFile, "FAKECLIENTIDFIRST"}, nil, &bytes.Buffer{}, stderr)
+	if code != 0 {
+		t.Errorf("authctl failed: clients rotate-keys exited with %d (%s)", code, stderr.String())
+	}
+
+	file := filepath.Join(t.TempDir(), "auth.db")
+	code = run([]string{"-server", server.URL, "-token", testAdminToken, "backup", "-file", file}, nil, &bytes.Buffer{}, stderr)
+	if data, _ := ioutil.ReadFile(file); code != 0 || string(data) != "FAKEBACKUP" {
+		t.Errorf("authctl failed: backup did not write the response to the file (%s)", stderr.String())
+	}
+}
+
+func TestFailRunCommand(t *testing.T) {
+	server := getTestAdminServer(t)
+	defer server.Close()
+
+	stderr := &bytes.Buffer{}
+	code := run([]string{"-server", server.URL, "-token", "ThisIsAnotherFakeStringThatShouldBreak", "clients", "list"}, nil, &bytes.Buffer{}, stderr)
+	if code == 0 || !strings.Contains(stderr.String(), "403") {
+		t.Errorf("authctl failed: Did not report a rejected admin token (%s)", stderr.String())
+	}
+
+	code = run([]string{"-server", server.URL, "-token", testAdminToken, "clients", "frobnicate"}, nil, &bytes.Buffer{}, stderr)
+	if code == 0 {
+		t.Errorf("authctl failed: Accepted an unknown command")
+	}
+
+	code = run([]string{"-server", server.URL, "-token", testAdminToken, "tokens", "revoke"}, nil, &bytes.Buffer{}, stderr)
+	if code == 0 {
+		t.Errorf("authctl failed: Revoked tokens without a filter")
+	}
+
+	file := filepath.Join(t.TempDir(), "auth.db")
+	code = run([]string{"-server", server.URL, "-token", "ThisIsAnotherFakeStringThatShouldBreak", "backup", "-file", file}, nil, &bytes.Buffer{}, stderr)
+	if _, err := os.Stat(file); code == 0 || err == nil {
+		t.Errorf("authctl failed: Failed backup left a file behind")
+	}
+}